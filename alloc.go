@@ -0,0 +1,139 @@
+// MIT License
+//
+// Copyright (c) 2017 Ryan Fowler
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package tree
+
+import "sync"
+
+// allocator is the strategy used by a RedBlackTree to allocate and release
+// its nodes. A tree without an allocator allocates every node on the heap,
+// leaving released nodes to the garbage collector.
+type allocator interface {
+	newNode(parent *node, item Item) *node
+	freeNode(n *node)
+}
+
+// DefaultFreeListSize is the default size of a FreeList created by
+// NewWithFreeList.
+const DefaultFreeListSize = 32
+
+// FreeList is a list of released nodes that may be reused by a RedBlackTree,
+// reducing allocations for workloads with frequent inserts and deletes.
+//
+// A FreeList is safe for concurrent use, and may be shared by multiple trees.
+type FreeList struct {
+	mu    sync.Mutex
+	nodes []*node
+}
+
+// NewFreeList returns a new FreeList that holds up to 'size' released nodes.
+func NewFreeList(size int) *FreeList {
+	return &FreeList{nodes: make([]*node, 0, size)}
+}
+
+func (f *FreeList) newNode(parent *node, item Item) *node {
+	f.mu.Lock()
+	index := len(f.nodes) - 1
+	if index < 0 {
+		f.mu.Unlock()
+		return newNode(parent, item)
+	}
+	n := f.nodes[index]
+	f.nodes[index] = nil
+	f.nodes = f.nodes[:index]
+	f.mu.Unlock()
+
+	n.colour = colourRed
+	n.parent = parent
+	n.item = item
+	return n
+}
+
+func (f *FreeList) freeNode(n *node) {
+	// Clear the node so that it doesn't retain its item, or other nodes.
+	*n = node{}
+	f.mu.Lock()
+	if len(f.nodes) < cap(f.nodes) {
+		f.nodes = append(f.nodes, n)
+	}
+	f.mu.Unlock()
+}
+
+// WithFreeList configures the RedBlackTree to reuse released nodes from the
+// provided FreeList. If 'f' is nil, a new FreeList of size DefaultFreeListSize
+// is used.
+func WithFreeList(f *FreeList) Option {
+	if f == nil {
+		f = NewFreeList(DefaultFreeListSize)
+	}
+	return func(t *RedBlackTree) {
+		t.alloc = f
+	}
+}
+
+// NewWithFreeList returns a new, empty RedBlackTree that reuses released
+// nodes from the provided FreeList. It is equivalent to
+// New(WithFreeList(f)).
+func NewWithFreeList(f *FreeList) *RedBlackTree {
+	return New(WithFreeList(f))
+}
+
+func (t *RedBlackTree) newNode(parent *node, item Item) *node {
+	var n *node
+	if t.alloc == nil {
+		n = newNode(parent, item)
+	} else {
+		n = t.alloc.newNode(parent, item)
+	}
+	if t.accesses != nil {
+		t.accesses[n] = new(uint64)
+	}
+	if t.ids != nil {
+		t.lastID++
+		t.ids[n] = t.lastID
+	}
+	return n
+}
+
+func (t *RedBlackTree) freeNode(n *node) {
+	if n == t.finger {
+		t.finger = nil
+	}
+	delete(t.accesses, n)
+	delete(t.ids, n)
+	if t.alloc != nil {
+		t.alloc.freeNode(n)
+	}
+}
+
+// moveState moves the optional per-node state of node 'from' to node 'to',
+// such as when an item is moved between nodes.
+func (t *RedBlackTree) moveState(from, to *node) {
+	if t.accesses != nil {
+		t.accesses[to] = t.accesses[from]
+		delete(t.accesses, from)
+	}
+	if t.ids != nil {
+		t.ids[to] = t.ids[from]
+		delete(t.ids, from)
+	}
+}
@@ -0,0 +1,120 @@
+package tree_test
+
+import (
+	"testing"
+
+	"github.com/ryanfowler/tree"
+)
+
+func TestNewWithFreeList(t *testing.T) {
+	const size = 1000
+
+	f := tree.NewFreeList(64)
+	rb := tree.NewWithFreeList(f)
+	for i := 0; i < size; i++ {
+		rb.Upsert(tree.Int(i))
+	}
+	for i := 0; i < size; i += 2 {
+		if it := rb.Delete(tree.Int(i)); it != tree.Int(i) {
+			t.Fatalf("Unexpected deleted item: %v", it)
+		}
+	}
+	if n, retaining := tree.FreeListSize(f); n != 64 || retaining != 0 {
+		t.Fatalf("Unexpected free list: %d nodes, %d retaining", n, retaining)
+	}
+
+	// Released nodes are reused, sharing the free list between trees.
+	other := tree.NewWithFreeList(f)
+	for i := 0; i < size; i += 2 {
+		other.Upsert(tree.Int(i))
+	}
+	if n, _ := tree.FreeListSize(f); n != 0 {
+		t.Fatalf("Unexpected free list size after reuse: %d", n)
+	}
+	rb.RetainIf(func(item tree.Item) bool {
+		return item.(tree.Int)%3 != 0
+	})
+
+	for _, tr := range []*tree.RedBlackTree{rb, other} {
+		if err := tree.Verify(tr); err != nil {
+			t.Fatalf("Invalid tree: %v", err)
+		}
+	}
+	for i := 0; i < size; i++ {
+		if exists := rb.Exists(tree.Int(i)); exists != (i%2 == 1 && i%3 != 0) {
+			t.Fatalf("Unexpected existence in first tree for %d: %t", i, exists)
+		}
+		if exists := other.Exists(tree.Int(i)); exists != (i%2 == 0) {
+			t.Fatalf("Unexpected existence in second tree for %d: %t", i, exists)
+		}
+	}
+
+	if rb := tree.NewWithFreeList(nil); rb.Upsert(tree.Int(1)) != nil || rb.Delete(tree.Int(1)) != tree.Int(1) {
+		t.Fatal("Unexpected behaviour with default free list")
+	}
+}
+
+func TestNewWithOptions(t *testing.T) {
+	f := tree.NewFreeList(64)
+	rb := tree.New(
+		tree.WithBounds(&counter{key: 0}, &counter{key: 100}),
+		tree.WithLazyDelete(),
+		tree.WithInsertOnce(),
+		tree.WithTracking(),
+		tree.WithFreeList(f),
+	)
+	for i := 0; i < 100; i++ {
+		rb.Upsert(&counter{key: i, count: i})
+	}
+	if _, err := rb.TryUpsert(&counter{key: 100}); err != tree.ErrOutOfRange {
+		t.Fatalf("Unexpected error for out of range item: %v", err)
+	}
+	rb.Upsert(&counter{key: 1, count: 10})
+	if c := rb.Get(&counter{key: 1}).(*counter); c.count != 1 {
+		t.Fatalf("Unexpected replacement of existing item: %d", c.count)
+	}
+	if hot := rb.HotKeys(1); len(hot) != 1 || hot[0].(*counter).key != 1 {
+		t.Fatalf("Unexpected hot keys: %v", hot)
+	}
+
+	for i := 0; i < 100; i += 2 {
+		rb.Delete(&counter{key: i})
+	}
+	if rb.Size() != 50 {
+		t.Fatalf("Unexpected size: %d", rb.Size())
+	}
+	if n, _ := tree.FreeListSize(f); n != 0 {
+		t.Fatalf("Unexpected free list size before compaction: %d", n)
+	}
+	if removed := rb.Compact(); removed != 50 {
+		t.Fatalf("Unexpected number of compacted tombstones: %d", removed)
+	}
+	if n, retaining := tree.FreeListSize(f); n != 50 || retaining != 0 {
+		t.Fatalf("Unexpected free list: %d nodes, %d retaining", n, retaining)
+	}
+	if err := tree.Verify(rb); err != nil {
+		t.Fatalf("Invalid tree: %v", err)
+	}
+}
+
+func benchmarkUpsertDelete(b *testing.B, rb *tree.RedBlackTree) {
+	const size = 1 << 10
+
+	for i := 0; i < size; i++ {
+		rb.Upsert(tree.Int(i))
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rb.Delete(tree.Int(i % size))
+		rb.Upsert(tree.Int(i % size))
+	}
+}
+
+func BenchmarkUpsertDeleteHeap(b *testing.B) {
+	benchmarkUpsertDelete(b, new(tree.RedBlackTree))
+}
+
+func BenchmarkUpsertDeleteFreeList(b *testing.B) {
+	benchmarkUpsertDelete(b, tree.NewWithFreeList(nil))
+}
@@ -0,0 +1,129 @@
+// MIT License
+//
+// Copyright (c) 2017 Ryan Fowler
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package tree
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// ErrInvalidEncoding is returned when decoding a tree from input that was not
+// produced by the matching encoder.
+var ErrInvalidEncoding = errors.New("tree: invalid encoding")
+
+// DeltaEncode writes the items of the RedBlackTree to 'w' in ascending order
+// as a compact sequence of integers, where 'toInt' returns the integer key of
+// an item. The number of items is written first, followed by the key of the
+// first item as a varint and the difference between each pair of consecutive
+// keys as a uvarint. As the keys are sorted, the differences are small for
+// densely packed keys. Differences are computed as unsigned integers, so keys
+// may span the full range of an int64.
+//
+// O(n) where n is the total number of items in the tree.
+func (t *RedBlackTree) DeltaEncode(w io.Writer, toInt func(Item) int64) error {
+	bw := bufio.NewWriter(w)
+	var buf [binary.MaxVarintLen64]byte
+	if _, err := bw.Write(buf[:binary.PutUvarint(buf[:], uint64(t.size))]); err != nil {
+		return err
+	}
+	var prev int64
+	for n, first := t.minNode(), true; n != nil; n, first = n.next(), false {
+		key := toInt(n.item)
+		var size int
+		if first {
+			size = binary.PutVarint(buf[:], key)
+		} else {
+			size = binary.PutUvarint(buf[:], uint64(key)-uint64(prev))
+		}
+		if _, err := bw.Write(buf[:size]); err != nil {
+			return err
+		}
+		prev = key
+	}
+	return bw.Flush()
+}
+
+// DeltaDecode reads items written by DeltaEncode from 'r', returning a new,
+// balanced RedBlackTree containing them, where 'fromInt' returns the item for
+// an integer key. ErrInvalidEncoding is returned if the keys are not in
+// strictly ascending order, and io.ErrUnexpectedEOF if the input ends early.
+//
+// O(n) where n is the number of items read.
+func DeltaDecode(r io.Reader, fromInt func(int64) Item) (*RedBlackTree, error) {
+	br, ok := r.(io.ByteReader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	size, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, err
+	}
+	var items []Item
+	var key int64
+	for i := uint64(0); i < size; i++ {
+		var err error
+		if i == 0 {
+			key, err = binary.ReadVarint(br)
+		} else {
+			var delta uint64
+			delta, err = binary.ReadUvarint(br)
+			next := int64(uint64(key) + delta)
+			if err == nil && next <= key {
+				// The delta is zero, or overflows the key.
+				return nil, ErrInvalidEncoding
+			}
+			key = next
+		}
+		if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, fromInt(key))
+	}
+	return buildTree(items), nil
+}
+
+// SnapshotReaderAt serializes the items of the RedBlackTree in ascending order,
+// returning a reader providing random access to the serialized bytes, along
+// with their total size. Each item is serialized as the result of calling
+// 'encode' with it, prefixed with its length as a uvarint.
+//
+// The serialization is materialized once, so the reader is unaffected by later
+// changes to the tree.
+//
+// O(n) where n is the total number of items in the tree.
+func (t *RedBlackTree) SnapshotReaderAt(encode func(Item) []byte) (io.ReaderAt, int64) {
+	var buf []byte
+	var prefix [binary.MaxVarintLen64]byte
+	for n := t.minNode(); n != nil; n = n.next() {
+		b := encode(n.item)
+		buf = append(buf, prefix[:binary.PutUvarint(prefix[:], uint64(len(b)))]...)
+		buf = append(buf, b...)
+	}
+	return bytes.NewReader(buf), int64(len(buf))
+}
@@ -0,0 +1,121 @@
+package tree_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"strconv"
+	"testing"
+
+	"github.com/ryanfowler/tree"
+)
+
+// int64Item is an Item holding an int64, which unlike tree.Int has the same
+// range on all platforms.
+type int64Item int64
+
+func (i int64Item) Less(than tree.Item) bool {
+	return i < than.(int64Item)
+}
+
+func TestDeltaEncode(t *testing.T) {
+	toInt := func(item tree.Item) int64 { return int64(item.(tree.Int)) }
+	fromInt := func(key int64) tree.Item { return tree.Int(key) }
+
+	var rb tree.RedBlackTree
+	for i := 0; i < 1000; i++ {
+		rb.Upsert(tree.Int(i*3 - 500))
+	}
+	var buf bytes.Buffer
+	if err := rb.DeltaEncode(&buf, toInt); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	encoded := buf.Bytes()
+	if len(encoded) > 1010 {
+		t.Fatalf("Unexpected encoded size: %d", len(encoded))
+	}
+
+	decoded, err := tree.DeltaDecode(bytes.NewReader(encoded), fromInt)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := tree.Verify(decoded); err != nil {
+		t.Fatalf("Invalid tree: %v", err)
+	}
+	if !decoded.EqualStreaming(&rb, nil) {
+		t.Fatal("Unexpected decoded tree")
+	}
+
+	if _, err := tree.DeltaDecode(bytes.NewReader(encoded[:500]), fromInt); err != io.ErrUnexpectedEOF {
+		t.Fatalf("Unexpected error for truncated input: %v", err)
+	}
+	// Two items with a zero delta between them.
+	if _, err := tree.DeltaDecode(bytes.NewReader([]byte{2, 2, 0}), fromInt); err != tree.ErrInvalidEncoding {
+		t.Fatalf("Unexpected error for unordered input: %v", err)
+	}
+
+	// Keys spanning more than the range of a positive int64.
+	var wide tree.RedBlackTree
+	for _, i := range []int64Item{math.MinInt64 + 1, math.MaxInt64} {
+		wide.Upsert(i)
+	}
+	buf.Reset()
+	if err := wide.DeltaEncode(&buf, func(item tree.Item) int64 { return int64(item.(int64Item)) }); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	decoded, err = tree.DeltaDecode(&buf, func(key int64) tree.Item { return int64Item(key) })
+	if err != nil || !decoded.EqualStreaming(&wide, nil) {
+		t.Fatalf("Unexpected decoded wide tree: %v", err)
+	}
+	// A delta overflowing the maximum key.
+	key := make([]byte, binary.MaxVarintLen64)
+	overflow := append([]byte{2}, key[:binary.PutVarint(key, math.MaxInt64)]...)
+	overflow = append(overflow, 1)
+	if _, err := tree.DeltaDecode(bytes.NewReader(overflow), fromInt); err != tree.ErrInvalidEncoding {
+		t.Fatalf("Unexpected error for overflowing input: %v", err)
+	}
+
+	var empty tree.RedBlackTree
+	buf.Reset()
+	if err := empty.DeltaEncode(&buf, toInt); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if decoded, err := tree.DeltaDecode(&buf, fromInt); err != nil || decoded.Size() != 0 {
+		t.Fatalf("Unexpected decoded empty tree: %v", err)
+	}
+}
+
+func TestSnapshotReaderAt(t *testing.T) {
+	encode := func(item tree.Item) []byte {
+		return []byte(strconv.Itoa(int(item.(tree.Int))))
+	}
+
+	var rb tree.RedBlackTree
+	var full []byte
+	for i := 0; i < 200; i++ {
+		rb.Upsert(tree.Int(i * 7))
+		b := encode(tree.Int(i * 7))
+		full = append(full, byte(len(b)))
+		full = append(full, b...)
+	}
+
+	r, size := rb.SnapshotReaderAt(encode)
+	if size != int64(len(full)) {
+		t.Fatalf("Unexpected size: %d - %d", size, len(full))
+	}
+	rb.Upsert(tree.Int(-1))
+
+	for _, rng := range [][2]int{{0, 10}, {100, 150}, {len(full) - 5, len(full)}} {
+		buf := make([]byte, rng[1]-rng[0])
+		if n, err := r.ReadAt(buf, int64(rng[0])); n != len(buf) || (err != nil && err != io.EOF) {
+			t.Fatalf("Unexpected read: %d, %v", n, err)
+		}
+		if !bytes.Equal(buf, full[rng[0]:rng[1]]) {
+			t.Fatalf("Unexpected bytes at %v: %q", rng, buf)
+		}
+	}
+	if n, err := r.ReadAt(make([]byte, 10), size-4); n != 4 || err != io.EOF {
+		t.Fatalf("Unexpected read past end: %d, %v", n, err)
+	}
+}
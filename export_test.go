@@ -0,0 +1,87 @@
+package tree
+
+import "fmt"
+
+// Verify checks the red-black tree invariants of the provided tree, returning
+// an error describing the first violation found.
+func Verify(t *RedBlackTree) error {
+	if t.root == nil {
+		if t.size != 0 {
+			return fmt.Errorf("empty tree with size %d", t.size)
+		}
+		return nil
+	}
+	if t.root.parent != nil {
+		return fmt.Errorf("root has parent")
+	}
+	if t.root.isRed() {
+		return fmt.Errorf("root is red")
+	}
+	size, _, err := verifyNode(t.root)
+	if err != nil {
+		return err
+	}
+	if size != t.size+t.tombstones {
+		return fmt.Errorf("tree has %d nodes but size %d and %d tombstones", size, t.size, t.tombstones)
+	}
+	var prev *node
+	var dead int
+	for n := t.root.min(); n != nil; n = n.successor() {
+		if prev != nil && !prev.item.Less(n.item) {
+			return fmt.Errorf("items out of order: %v, %v", prev.item, n.item)
+		}
+		if n.dead {
+			dead++
+		}
+		prev = n
+	}
+	if dead != t.tombstones {
+		return fmt.Errorf("tree has %d dead nodes but %d tombstones", dead, t.tombstones)
+	}
+	return nil
+}
+
+func verifyNode(n *node) (size, blackHeight int, err error) {
+	if n == nil {
+		return 0, 1, nil
+	}
+	for _, child := range []*node{n.left, n.right} {
+		if child == nil {
+			continue
+		}
+		if child.parent != n {
+			return 0, 0, fmt.Errorf("bad parent pointer at %v", child.item)
+		}
+		if n.isRed() && child.isRed() {
+			return 0, 0, fmt.Errorf("red node %v has red child %v", n.item, child.item)
+		}
+	}
+	lsize, lheight, err := verifyNode(n.left)
+	if err != nil {
+		return 0, 0, err
+	}
+	rsize, rheight, err := verifyNode(n.right)
+	if err != nil {
+		return 0, 0, err
+	}
+	if lheight != rheight {
+		return 0, 0, fmt.Errorf("unequal black heights at %v: %d, %d", n.item, lheight, rheight)
+	}
+	if n.isBlack() {
+		lheight++
+	}
+	return lsize + rsize + 1, lheight, nil
+}
+
+// FreeListSize returns the number of nodes in the free list, and the number
+// of them still holding a reference to an item or another node.
+func FreeListSize(f *FreeList) (size, retaining int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, n := range f.nodes {
+		if n.item != nil || n.parent != nil || n.left != nil || n.right != nil {
+			retaining++
+		}
+	}
+	return len(f.nodes), retaining
+}
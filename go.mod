@@ -0,0 +1,3 @@
+module github.com/ryanfowler/tree
+
+go 1.13
@@ -0,0 +1,149 @@
+// MIT License
+//
+// Copyright (c) 2017 Ryan Fowler
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package tree
+
+// SecondaryIndex maintains a RedBlackTree of items alongside a second tree
+// that orders the same items by a secondary key, keeping the two consistent
+// as items are upserted and deleted. Items are unique by their own ordering,
+// while any number of items may share a secondary key.
+//
+// Like a RedBlackTree, read-only operations may occur concurrently, but any
+// write operation must be serially executed.
+type SecondaryIndex struct {
+	key       func(Item) Item
+	primary   RedBlackTree
+	secondary RedBlackTree
+}
+
+// NewSecondaryIndex returns a new, empty SecondaryIndex where the function
+// 'key' returns the secondary key of an item. The secondary key of an item
+// must not change while the item is stored in the index.
+func NewSecondaryIndex(key func(Item) Item) *SecondaryIndex {
+	return &SecondaryIndex{key: key}
+}
+
+// indexEntry is an item in the secondary tree, ordered by its key and then by
+// the item itself. An entry with a nil item is less than every other entry
+// with an equal key.
+type indexEntry struct {
+	key, item Item
+}
+
+func (e indexEntry) Less(than Item) bool {
+	o := than.(indexEntry)
+	switch {
+	case e.key.Less(o.key):
+		return true
+	case o.key.Less(e.key), o.item == nil:
+		return false
+	case e.item == nil:
+		return true
+	}
+	return e.item.Less(o.item)
+}
+
+// Upsert inserts or replaces an item in both orderings of the index, returning
+// the item that was replaced, or nil if there was no equal item.
+//
+// O(log(n))
+func (s *SecondaryIndex) Upsert(item Item) Item {
+	old := s.primary.Upsert(item)
+	if old != nil {
+		s.secondary.Delete(indexEntry{key: s.key(old), item: old})
+	}
+	s.secondary.Upsert(indexEntry{key: s.key(item), item: item})
+	return old
+}
+
+// Delete deletes an item equal to the provided item from both orderings of the
+// index, returning it. If there is no equal item, nil is returned.
+//
+// O(log(n))
+func (s *SecondaryIndex) Delete(item Item) Item {
+	old := s.primary.Delete(item)
+	if old != nil {
+		s.secondary.Delete(indexEntry{key: s.key(old), item: old})
+	}
+	return old
+}
+
+// Get retrieves an item in the index equal to the provided item. If an item
+// was found, it is returned. Otherwise, nil is returned.
+//
+// O(log(n))
+func (s *SecondaryIndex) Get(item Item) Item {
+	return s.primary.Get(item)
+}
+
+// Size returns the number of items in the index.
+//
+// O(1)
+func (s *SecondaryIndex) Size() int {
+	return s.primary.Size()
+}
+
+// Ascend calls 'fn' for each item in the index in ascending order until no
+// items remain or fn returns 'false'.
+//
+// O(log(n) + m) where n is the total number of items in the index and m is
+// the number of items ranged over.
+func (s *SecondaryIndex) Ascend(fn func(Item) bool) {
+	s.primary.Ascend(fn)
+}
+
+// AscendRange calls 'fn' for each item in the index greater or equal to
+// 'greaterOrEqual' and less than 'lessThan', in ascending order, until no items
+// remain in the range or fn returns 'false'.
+//
+// O(log(n) + m) where n is the total number of items in the index and m is
+// the number of items ranged over.
+func (s *SecondaryIndex) AscendRange(greaterOrEqual, lessThan Item, fn func(Item) bool) {
+	s.primary.AscendRange(greaterOrEqual, lessThan, fn)
+}
+
+// AscendSecondary calls 'fn' for each item in the index in ascending order of
+// secondary key until no items remain or fn returns 'false'. Items with equal
+// secondary keys are visited in ascending order.
+//
+// O(log(n) + m) where n is the total number of items in the index and m is
+// the number of items ranged over.
+func (s *SecondaryIndex) AscendSecondary(fn func(Item) bool) {
+	s.secondary.Ascend(func(e Item) bool {
+		return fn(e.(indexEntry).item)
+	})
+}
+
+// AscendSecondaryRange calls 'fn' for each item in the index with a secondary
+// key greater or equal to 'greaterOrEqual' and less than 'lessThan', in
+// ascending order of secondary key, until no items remain in the range or fn
+// returns 'false'. Items with equal secondary keys are visited in ascending
+// order.
+//
+// O(log(n) + m) where n is the total number of items in the index and m is
+// the number of items ranged over.
+func (s *SecondaryIndex) AscendSecondaryRange(greaterOrEqual, lessThan Item, fn func(Item) bool) {
+	lo, hi := indexEntry{key: greaterOrEqual}, indexEntry{key: lessThan}
+	s.secondary.AscendRange(lo, hi, func(e Item) bool {
+		return fn(e.(indexEntry).item)
+	})
+}
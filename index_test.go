@@ -0,0 +1,93 @@
+package tree_test
+
+import (
+	"testing"
+
+	"github.com/ryanfowler/tree"
+)
+
+type record struct {
+	id, timestamp int
+}
+
+func (r *record) Less(than tree.Item) bool {
+	return r.id < than.(*record).id
+}
+
+func TestSecondaryIndex(t *testing.T) {
+	idx := tree.NewSecondaryIndex(func(item tree.Item) tree.Item {
+		return tree.Int(item.(*record).timestamp)
+	})
+	for i := 0; i < 100; i++ {
+		if old := idx.Upsert(&record{id: i, timestamp: (i * 37) % 50}); old != nil {
+			t.Fatalf("Unexpected replaced record: %v", old)
+		}
+	}
+	if idx.Size() != 100 {
+		t.Fatalf("Unexpected size: %d", idx.Size())
+	}
+
+	// Query by id.
+	if r := idx.Get(&record{id: 42}); r == nil || r.(*record).timestamp != (42*37)%50 {
+		t.Fatalf("Unexpected record: %v", r)
+	}
+	var ids []int
+	idx.AscendRange(&record{id: 10}, &record{id: 15}, func(item tree.Item) bool {
+		ids = append(ids, item.(*record).id)
+		return true
+	})
+	if len(ids) != 5 || ids[0] != 10 || ids[4] != 14 {
+		t.Fatalf("Unexpected ids: %v", ids)
+	}
+
+	// Query by timestamp.
+	var prev *record
+	var count int
+	idx.AscendSecondary(func(item tree.Item) bool {
+		r := item.(*record)
+		if prev != nil && (r.timestamp < prev.timestamp || r.timestamp == prev.timestamp && r.id < prev.id) {
+			t.Fatalf("Unexpected order: %v, %v", prev, r)
+		}
+		prev = r
+		count++
+		return true
+	})
+	if count != 100 {
+		t.Fatalf("Unexpected number of records: %d", count)
+	}
+	var records []*record
+	idx.AscendSecondaryRange(tree.Int(10), tree.Int(12), func(item tree.Item) bool {
+		records = append(records, item.(*record))
+		return true
+	})
+	if len(records) != 4 {
+		t.Fatalf("Unexpected number of records: %d", len(records))
+	}
+	for _, r := range records {
+		if r.timestamp < 10 || r.timestamp >= 12 {
+			t.Fatalf("Unexpected record: %v", r)
+		}
+	}
+
+	// Replacing a record moves it to its new timestamp.
+	if old := idx.Upsert(&record{id: 42, timestamp: 1000}); old == nil {
+		t.Fatal("Expected replaced record")
+	}
+	idx.Delete(&record{id: 0})
+	records = records[:0]
+	idx.AscendSecondaryRange(tree.Int(0), tree.Int(2000), func(item tree.Item) bool {
+		records = append(records, item.(*record))
+		return true
+	})
+	if len(records) != 99 || idx.Size() != 99 {
+		t.Fatalf("Unexpected number of records: %d, %d", len(records), idx.Size())
+	}
+	if last := records[len(records)-1]; last.id != 42 || last.timestamp != 1000 {
+		t.Fatalf("Unexpected last record: %v", last)
+	}
+	for _, r := range records {
+		if r.id == 0 {
+			t.Fatalf("Unexpected deleted record: %v", r)
+		}
+	}
+}
@@ -23,7 +23,38 @@
 // Package tree provides an implementation of a red-black tree.
 package tree
 
-import "bytes"
+import (
+	"bytes"
+	"container/heap"
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"sort"
+	"sync/atomic"
+)
+
+var (
+	// ErrNotFound is returned by TryGet when no matching Item exists in
+	// the tree.
+	ErrNotFound = errors.New("tree: item not found")
+
+	// ErrOutOfRange is returned by TryUpsert when upserting an Item
+	// outside of the range of a tree created with NewBounded.
+	ErrOutOfRange = errors.New("tree: item out of range")
+
+	// ErrMaxHeight is returned by TryUpsert when inserting an Item would
+	// exceed the maximum height set with SetMaxHeight.
+	ErrMaxHeight = errors.New("tree: maximum height exceeded")
+
+	// ErrVersionConflict is returned by VersionedAscend when the tree is
+	// modified during the iteration.
+	ErrVersionConflict = errors.New("tree: tree modified during iteration")
+)
+
+// DefaultCtxCheckInterval is the default number of items visited by AscendCtx
+// between checks for cancellation of its context.
+const DefaultCtxCheckInterval = 256
 
 // Item is the interface that wraps the Less method.
 //
@@ -34,6 +65,22 @@ type Item interface {
 	Less(Item) bool
 }
 
+// Comparer is an optional interface that Items may implement to compare
+// themselves against another Item in a single call.
+//
+// Compare should return a negative number if the instance is less than the
+// provided Item, a positive number if it is greater, and zero if they are
+// equal. It must be consistent with Less.
+//
+// Looking up or inserting an Item requires up to two calls to Less for each
+// node visited, but only one call to Compare. Implementing Comparer can
+// therefore significantly reduce the cost of lookups, upserts, and deletions
+// for Items with an expensive comparison.
+type Comparer interface {
+	Item
+	Compare(Item) int
+}
+
 // RedBlackTree is an in-memory implementation of a red-black tree.
 //
 // The internal data structure will automatically re-balance, and therefore
@@ -42,8 +89,209 @@ type Item interface {
 // Note: While read-only operations may occur concurrently, any write operation
 // must be serially executed (typically protected with a mutex).
 type RedBlackTree struct {
-	root *node
-	size int
+	root    *node
+	size    int
+	version uint64
+
+	combine    func(old, new Item) Item
+	insertOnce bool
+	tracking   bool
+	lazy       bool
+	tombstones int
+
+	lastRotations int
+	finger        *node
+
+	// accesses and ids hold the optional per-node state of trees created
+	// with WithTracking and WithStableIDs, keeping it out of every node.
+	accesses map[*node]*uint64
+	ids      map[*node]uint64
+	lastID   uint64
+
+	lo, hi    Item
+	maxHeight int
+
+	ctxCheckInterval int
+
+	onDelete func(Item)
+	onInsert func(item, replaced Item)
+
+	alloc allocator
+}
+
+// Option configures the behaviour of a RedBlackTree created with New.
+type Option func(t *RedBlackTree)
+
+// New returns a new, empty RedBlackTree configured with the provided options,
+// which are applied in order. Options may be freely combined, such as to
+// create a bounded, lazy-delete tree that reuses nodes from a FreeList.
+//
+// Each of the New* constructors, such as NewLazyDelete, is equivalent to
+// calling New with the corresponding option, such as WithLazyDelete.
+func New(opts ...Option) *RedBlackTree {
+	var t RedBlackTree
+	for _, opt := range opts {
+		opt(&t)
+	}
+	return &t
+}
+
+// WithAggregate configures the RedBlackTree such that, when an Item equal to
+// an existing Item is upserted, the result of 'combine' called with the
+// existing and new Items is stored rather than the new Item. If combined with
+// WithInsertOnce, the existing Item is kept and combine is not called.
+//
+// This is useful for maintaining per-key aggregates, such as summed counts.
+func WithAggregate(combine func(old, new Item) Item) Option {
+	return func(t *RedBlackTree) {
+		t.combine = combine
+	}
+}
+
+// WithInsertOnce configures the RedBlackTree such that upserting an Item equal
+// to an existing Item is a no-op. Unlike the default behaviour, the existing
+// Item is never replaced, so its payload cannot be clobbered.
+func WithInsertOnce() Option {
+	return func(t *RedBlackTree) {
+		t.insertOnce = true
+	}
+}
+
+// WithBounds configures the RedBlackTree to only accept Items greater than or
+// equal to 'lo' and less than 'hi'. Upserting an Item outside of this range
+// fails with ErrOutOfRange. Read operations are unrestricted.
+//
+// This is useful for enforcing that a windowed or sharded index only holds
+// the keys it is responsible for.
+func WithBounds(lo, hi Item) Option {
+	return func(t *RedBlackTree) {
+		t.lo, t.hi = lo, hi
+	}
+}
+
+// WithTracking configures the RedBlackTree to record diagnostic information
+// about its use. The number of times each item is accessed via Get or Exists
+// is counted, and the most frequently accessed items can be retrieved with
+// HotKeys. The number of rotations performed by the most recent upsert can be
+// retrieved with LastInsertRotations.
+//
+// Counting adds a small amount of overhead to every lookup, so it is only
+// enabled for trees created with this option.
+func WithTracking() Option {
+	return func(t *RedBlackTree) {
+		t.tracking = true
+		t.accesses = make(map[*node]*uint64)
+	}
+}
+
+// WithStableIDs configures the RedBlackTree to assign each item a stable ID
+// when it is inserted, which can be retrieved with AscendWithStableID.
+func WithStableIDs() Option {
+	return func(t *RedBlackTree) {
+		t.ids = make(map[*node]uint64)
+	}
+}
+
+// WithLazyDelete configures the RedBlackTree such that deleting an Item marks
+// its node as a tombstone rather than removing it from the tree. Tombstoned
+// Items are skipped by lookups and iteration and are not counted by Size, and
+// upserting an Item equal to a tombstoned Item reuses its node. Tombstones are
+// removed in bulk by calling Compact.
+//
+// This avoids the cost of rebalancing the tree when many Items are deleted and
+// similar Items are later re-inserted. However, each tombstone retains its node
+// and Item in memory until the tree is compacted, and lookups may visit
+// tombstoned nodes. Methods that expose the structure of the tree, such as
+// LevelOrder, Edges and FlattenToArray, include tombstoned nodes.
+func WithLazyDelete() Option {
+	return func(t *RedBlackTree) {
+		t.lazy = true
+	}
+}
+
+// NewAggregating returns a new, empty RedBlackTree that, when an Item equal to
+// an existing Item is upserted, stores the result of 'combine' called with the
+// existing and new Items rather than replacing the existing Item. It is
+// equivalent to New(WithAggregate(combine)).
+func NewAggregating(combine func(old, new Item) Item) *RedBlackTree {
+	return New(WithAggregate(combine))
+}
+
+// NewInsertOnce returns a new, empty RedBlackTree where upserting an Item
+// equal to an existing Item is a no-op. It is equivalent to
+// New(WithInsertOnce()).
+func NewInsertOnce() *RedBlackTree {
+	return New(WithInsertOnce())
+}
+
+// NewBounded returns a new, empty RedBlackTree that only accepts Items greater
+// than or equal to 'lo' and less than 'hi'. It is equivalent to
+// New(WithBounds(lo, hi)).
+func NewBounded(lo, hi Item) *RedBlackTree {
+	return New(WithBounds(lo, hi))
+}
+
+// NewTracking returns a new, empty RedBlackTree that records diagnostic
+// information about its use, such as the number of times each item is
+// accessed. It is equivalent to New(WithTracking()).
+func NewTracking() *RedBlackTree {
+	return New(WithTracking())
+}
+
+// NewWithStableIDs returns a new, empty RedBlackTree that assigns each item a
+// stable ID when it is inserted. It is equivalent to New(WithStableIDs()).
+func NewWithStableIDs() *RedBlackTree {
+	return New(WithStableIDs())
+}
+
+// NewLazyDelete returns a new, empty RedBlackTree where deleting an Item marks
+// its node as a tombstone rather than removing it from the tree. It is
+// equivalent to New(WithLazyDelete()).
+func NewLazyDelete() *RedBlackTree {
+	return New(WithLazyDelete())
+}
+
+// SetMaxHeight sets the maximum height of the RedBlackTree, as a number of
+// levels with the root at level one, such that inserting an Item that would
+// be placed below level 'h' fails with ErrMaxHeight and leaves the tree
+// unchanged. A height of zero or less removes the limit.
+//
+// The height of a red-black tree is at most 2*log2(n+1), so SetMaxHeight is a
+// debugging aid: a limit slightly above this bound signals an inconsistent
+// Less method or corrupted tree.
+func (t *RedBlackTree) SetMaxHeight(h int) {
+	t.maxHeight = h
+}
+
+// SetCtxCheckInterval sets the number of items visited by AscendCtx between
+// checks for cancellation of its context. A smaller interval detects
+// cancellation sooner, while a larger interval reduces the overhead of each
+// item. An interval of zero or less restores DefaultCtxCheckInterval.
+func (t *RedBlackTree) SetCtxCheckInterval(n int) {
+	t.ctxCheckInterval = n
+}
+
+// OnDelete registers 'fn' to be called exactly once for every item removed
+// from the RedBlackTree, replacing any previously registered function. A nil
+// function disables the hook.
+//
+// The hook is called after the item has been removed. For operations that
+// remove many items at once, such as RetainIf, the hook is called for each
+// removed item in ascending order once the operation is complete.
+func (t *RedBlackTree) OnDelete(fn func(Item)) {
+	t.onDelete = fn
+}
+
+// OnInsert registers 'fn' to be called for every item stored in the
+// RedBlackTree, replacing any previously registered function. A nil function
+// disables the hook.
+//
+// The hook is called after the item has been stored, with the item that it
+// replaced, or nil if the item is new. In a tree created with NewAggregating,
+// the stored item is the result of the combine function. In a tree created
+// with NewInsertOnce, the hook is not called when an existing item is kept.
+func (t *RedBlackTree) OnInsert(fn func(item, replaced Item)) {
+	t.onInsert = fn
 }
 
 // Ascend starts at the first Item and calls 'fn' for each Item until no
@@ -58,6 +306,243 @@ func (t *RedBlackTree) Ascend(fn func(Item) bool) {
 	}
 }
 
+// AscendCtx starts at the first Item and calls 'fn' for each Item until no
+// Items remain, fn returns 'false', or the context is cancelled. The context
+// is checked before the first Item and then after every interval of Items set
+// with SetCtxCheckInterval. If the context is cancelled, its error is
+// returned.
+//
+// O(log(n) + m) where n is the total number of items in the tree and m is the
+// number of items ranged over.
+func (t *RedBlackTree) AscendCtx(ctx context.Context, fn func(Item) bool) error {
+	interval := t.ctxCheckInterval
+	if interval <= 0 {
+		interval = DefaultCtxCheckInterval
+	}
+	var i int
+	for n := t.minNode(); n != nil; n = n.next() {
+		if i%interval == 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+		if !fn(n.item) {
+			return nil
+		}
+		i++
+	}
+	return nil
+}
+
+// AscendFilter starts at the first Item and calls 'fn' for each Item for which
+// 'pred' returns 'true', until no Items remain or fn returns 'false'. The
+// number of Items passed to fn is returned.
+//
+// O(log(n) + m) where n is the total number of items in the tree and m is the
+// number of items ranged over.
+func (t *RedBlackTree) AscendFilter(pred func(Item) bool, fn func(Item) bool) int {
+	var count int
+	for n := t.minNode(); n != nil; n = n.next() {
+		if !pred(n.item) {
+			continue
+		}
+		count++
+		if !fn(n.item) {
+			break
+		}
+	}
+	return count
+}
+
+// FirstNWhere returns, in ascending order, the first 'n' items in the
+// RedBlackTree for which 'pred' returns 'true'. If fewer than n items match,
+// all matching items are returned.
+//
+// O(log(n) + m) where n is the total number of items in the tree and m is the
+// number of items ranged over.
+func (t *RedBlackTree) FirstNWhere(n int, pred func(Item) bool) []Item {
+	var items []Item
+	for nd := t.minNode(); nd != nil && len(items) < n; nd = nd.next() {
+		if pred(nd.item) {
+			items = append(items, nd.item)
+		}
+	}
+	return items
+}
+
+// VersionedAscend starts at the first Item and calls 'fn' for each Item until
+// no Items remain or fn returns 'false'. If the RedBlackTree is modified during
+// the iteration, the iteration is aborted after fn returns and
+// ErrVersionConflict is returned, allowing the caller to retry. The tree's
+// version is incremented by every write, and checked after each call to fn.
+//
+// VersionedAscend only detects writes made by the goroutine performing the
+// iteration, such as by fn itself. As with any other read, a write from
+// another goroutine must not run at the same time. To iterate while writers in
+// other goroutines proceed, use the VersionedAscend method of a SyncTree.
+//
+// O(log(n) + m) where n is the total number of items in the tree and m is the
+// number of items ranged over.
+func (t *RedBlackTree) VersionedAscend(fn func(Item) bool) error {
+	version := t.version
+	for n := t.minNode(); n != nil; n = n.next() {
+		ok := fn(n.item)
+		if t.version != version {
+			return ErrVersionConflict
+		}
+		if !ok {
+			return nil
+		}
+	}
+	return nil
+}
+
+// TakeWhileBudget returns the longest prefix of the items in the RedBlackTree,
+// in ascending order, for which the sum of 'metric' over the items does not
+// exceed 'budget'. The first item that would exceed the budget, and every item
+// after it, is excluded.
+//
+// O(log(n) + m) where n is the total number of items in the tree and m is the
+// number of items ranged over.
+func (t *RedBlackTree) TakeWhileBudget(metric func(Item) float64, budget float64) []Item {
+	var items []Item
+	var total float64
+	for n := t.minNode(); n != nil; n = n.next() {
+		if total += metric(n.item); total > budget {
+			break
+		}
+		items = append(items, n.item)
+	}
+	return items
+}
+
+// AscendRanked starts at the first Item and calls 'fn' for each Item, along
+// with its zero-based rank (the number of Items less than it), until no Items
+// remain or fn returns 'false'.
+//
+// O(log(n) + m) where n is the total number of items in the tree and m is the
+// number of items ranged over.
+func (t *RedBlackTree) AscendRanked(fn func(rank int, item Item) bool) {
+	rank := 0
+	for n := t.minNode(); n != nil && fn(rank, n.item); n = n.next() {
+		rank++
+	}
+}
+
+// AscendUntil starts at the first Item and calls 'fn' for each Item until fn
+// returns 'true', returning that Item. If fn never returns 'true', nil is
+// returned.
+//
+// O(log(n) + m) where n is the total number of items in the tree and m is the
+// number of items ranged over.
+func (t *RedBlackTree) AscendUntil(fn func(Item) bool) Item {
+	for n := t.minNode(); n != nil; n = n.next() {
+		if fn(n.item) {
+			return n.item
+		}
+	}
+	return nil
+}
+
+// AscendAbsent calls 'fn' for each key in the universe from 'lo' to 'hi',
+// inclusive, that has no equal Item in the RedBlackTree, in ascending order,
+// until no keys remain or fn returns 'false'. The universe is enumerated by
+// repeatedly calling 'next', which must return a key greater than the one
+// provided.
+//
+// O(log(n) + u + m) where n is the total number of items in the tree, u is the
+// number of keys in the universe and m is the number of items in the range.
+func (t *RedBlackTree) AscendAbsent(lo, hi Item, next func(Item) Item, fn func(Item) bool) {
+	n := t.root.findGreaterOrEqual(lo)
+	for key := lo; !hi.Less(key); key = next(key) {
+		for n != nil && n.item.Less(key) {
+			n = n.next()
+		}
+		if (n == nil || key.Less(n.item)) && !fn(key) {
+			return
+		}
+	}
+}
+
+// AscendEqual starts at the first Item equal to the provided Item and calls
+// 'fn' for each Item equal to it until no equal Items remain or fn returns
+// 'false'. As a RedBlackTree does not store equal items, at most one Item is
+// visited.
+//
+// Note: equality for items a & b is: (!a.Less(b) && !b.Less(a)).
+//
+// O(log(n) + m) where n is the total number of items in the tree and m is the
+// number of items ranged over.
+func (t *RedBlackTree) AscendEqual(probe Item, fn func(Item) bool) {
+	n := t.root.findGreaterOrEqual(probe)
+	for n != nil && !probe.Less(n.item) && fn(n.item) {
+		n = n.next()
+	}
+}
+
+// AscendWithGapRank starts at the first Item and calls 'fn' for each Item,
+// along with its zero-based rank and the gap to the next Item as computed by
+// 'gap', until no Items remain or fn returns 'false'. The gap reported for the
+// last Item is zero.
+//
+// O(log(n) + m) where n is the total number of items in the tree and m is the
+// number of items ranged over.
+func (t *RedBlackTree) AscendWithGapRank(gap func(a, b Item) int, fn func(item Item, rank, gapToNext int) bool) {
+	n := t.minNode()
+	for rank := 0; n != nil; rank++ {
+		var g int
+		next := n.next()
+		if next != nil {
+			g = gap(n.item, next.item)
+		}
+		if !fn(n.item, rank, g) {
+			return
+		}
+		n = next
+	}
+}
+
+// AscendEvery samples the RedBlackTree at regular intervals. Starting with
+// 'start' as the target, it calls 'fn' with the first Item greater or equal to
+// the target, then advances the target by calling 'step' with it, until fn
+// returns 'false' or a target has no Item greater or equal to it. An Item that
+// is the first Item for multiple consecutive targets is only visited once.
+//
+// The function 'step' must return an Item greater than the one provided.
+//
+// O(m*log(n)) where n is the total number of items in the tree and m is the
+// number of targets.
+func (t *RedBlackTree) AscendEvery(start Item, step func(Item) Item, fn func(Item) bool) {
+	var last *node
+	for target := start; ; target = step(target) {
+		n := t.root.findGreaterOrEqual(target)
+		if n == nil {
+			return
+		}
+		if n != last && !fn(n.item) {
+			return
+		}
+		last = n
+	}
+}
+
+// AscendWithStableID starts at the first Item and calls 'fn' for each Item,
+// along with its stable ID, until no Items remain or fn returns 'false'.
+//
+// Each item is assigned a unique, monotonically increasing ID when it is
+// first inserted into the tree. An item keeps its ID when it is replaced by an
+// equal item, and regardless of rebalancing or the insertion or deletion of
+// other items, making it suitable as a display identity. If the tree was not
+// created with NewWithStableIDs, every ID is zero.
+//
+// O(log(n) + m) where n is the total number of items in the tree and m is the
+// number of items ranged over.
+func (t *RedBlackTree) AscendWithStableID(fn func(item Item, id uint64) bool) {
+	for n := t.minNode(); n != nil && fn(n.item, t.ids[n]); {
+		n = n.next()
+	}
+}
+
 // AscendGreaterOrEqual starts at the first Item greater or equal to the
 // provided Item and calls 'fn' for each Item until no Items remain in the tree
 // or fn returns 'false'.
@@ -83,6 +568,134 @@ func (t *RedBlackTree) AscendLess(thanItem Item, fn func(Item) bool) {
 	}
 }
 
+// AscendLeaves calls 'fn' for each leaf Item (an Item with no children) in
+// ascending order, along with the number of black nodes on the path from the
+// root to the leaf inclusive, until no leaves remain or fn returns 'false'.
+//
+// In a valid red-black tree, every leaf reports the same black height. In a
+// tree created with NewLazyDelete, tombstoned leaves are skipped.
+//
+// O(n) where n is the total number of items in the tree.
+func (t *RedBlackTree) AscendLeaves(fn func(item Item, blackHeight int) bool) {
+	t.root.ascendLeaves(0, fn)
+}
+
+func (n *node) ascendLeaves(blackHeight int, fn func(Item, int) bool) bool {
+	if n == nil {
+		return true
+	}
+	if n.isBlack() {
+		blackHeight++
+	}
+	if n.left == nil && n.right == nil {
+		return n.dead || fn(n.item, blackHeight)
+	}
+	return n.left.ascendLeaves(blackHeight, fn) && n.right.ascendLeaves(blackHeight, fn)
+}
+
+// AscendMutable starts at the first Item and calls 'fn' with a cursor for each
+// Item until no Items remain or fn returns 'false'. The cursor may be used to
+// delete the current Item without disrupting the iteration. The cursor is
+// only valid for the duration of the call to fn.
+//
+// O(log(n) + m) where n is the total number of items in the tree and m is the
+// number of items ranged over, plus O(log(n)) for each deletion.
+func (t *RedBlackTree) AscendMutable(fn func(c *MutCursor) bool) {
+	c := MutCursor{t: t}
+	for n := t.minNode(); n != nil; {
+		c.n, c.item, c.next = n, n.item, nil
+		if !fn(&c) {
+			return
+		}
+		if c.n != nil {
+			n = n.next()
+		} else {
+			n = c.next
+		}
+	}
+}
+
+// MutCursor is a cursor over the Items of a RedBlackTree that allows the
+// current Item to be deleted during iteration. See AscendMutable.
+type MutCursor struct {
+	t    *RedBlackTree
+	n    *node
+	item Item
+	next *node
+}
+
+// Item returns the current Item of the cursor.
+func (c *MutCursor) Item() Item {
+	return c.item
+}
+
+// Delete deletes the current Item of the cursor from the tree, returning it.
+// If the Item has already been deleted, nil is returned.
+//
+// O(log(n))
+func (c *MutCursor) Delete() Item {
+	if c.n == nil {
+		return nil
+	}
+	var item Item
+	c.next, item = c.n.deleteAndNext(c.t)
+	c.n = nil
+	return item
+}
+
+// AscendNeighbors starts at the first Item and calls 'fn' for each Item along
+// with its predecessor and successor, until no Items remain or fn returns
+// 'false'. The predecessor of the first Item and the successor of the last
+// Item are nil.
+//
+// O(log(n) + m) where n is the total number of items in the tree and m is the
+// number of items ranged over.
+func (t *RedBlackTree) AscendNeighbors(fn func(prev, cur, next Item) bool) {
+	var prev Item
+	for n := t.minNode(); n != nil; {
+		next := n.next()
+		var nextItem Item
+		if next != nil {
+			nextItem = next.item
+		}
+		if !fn(prev, n.item, nextItem) {
+			return
+		}
+		prev, n = n.item, next
+	}
+}
+
+// AscendPages starts at the first Item and calls 'fn' with pages of up to
+// 'pageSize' Items in ascending order until no Items remain or fn returns
+// 'false'. Every page is full except possibly the last. A new slice is
+// allocated for each page, so fn may safely retain it.
+//
+// AscendPages panics if pageSize is not positive.
+//
+// O(log(n) + m) where n is the total number of items in the tree and m is the
+// number of items ranged over.
+func (t *RedBlackTree) AscendPages(pageSize int, fn func(page []Item) bool) {
+	if pageSize <= 0 {
+		panic("tree: page size must be positive")
+	}
+	var page []Item
+	for n := t.minNode(); n != nil; n = n.next() {
+		if page == nil {
+			page = make([]Item, 0, pageSize)
+		}
+		page = append(page, n.item)
+		if len(page) == pageSize {
+			if !fn(page) {
+				return
+			}
+			page = nil
+		}
+	}
+	if len(page) > 0 {
+		fn(page)
+	}
+}
+
 // AscendRange starts at the first Item greater or equal to 'greaterOrEqual'
 // and calls 'fn' for each Item less than 'lessThan' or when fn returns 'false'.
 //
@@ -95,141 +708,2177 @@ func (t *RedBlackTree) AscendRange(greaterOrEqual, lessThan Item, fn func(Item)
 	}
 }
 
+// Range calls 'fn' for each Item greater or equal to 'lo' and less than 'hi'
+// until no Items remain in the range or fn returns 'false'. Items are visited
+// in ascending order, or in descending order if 'desc' is 'true'.
+//
+// O(log(n) + m) where n is the total number of items in the tree and m is the
+// number of items ranged over.
+func (t *RedBlackTree) Range(lo, hi Item, desc bool, fn func(Item) bool) {
+	if !desc {
+		t.AscendRange(lo, hi, fn)
+		return
+	}
+	n := t.root.findLess(hi)
+	for n != nil && !n.item.Less(lo) && fn(n.item) {
+		n = n.prev()
+	}
+}
+
 // Descend starts at the last Item and calls 'fn' for each Item until no
 // Items remain or fn returns 'false'.
 //
 // O(log(n) + m) where n is the total number of items in the tree and m is the
 // number of items ranged over.
-func (t *RedBlackTree) Descend(fn func(Item) bool) {
-	n := t.maxNode()
-	for n != nil && fn(n.item) {
-		n = n.prev()
+func (t *RedBlackTree) Descend(fn func(Item) bool) {
+	n := t.maxNode()
+	for n != nil && fn(n.item) {
+		n = n.prev()
+	}
+}
+
+// CommonPrefix returns the longest prefix shared by every String item in the
+// RedBlackTree. As the items are sorted, this is the common prefix of the
+// minimum and maximum items. If the tree is empty, or the items share no
+// prefix, "" is returned. If the minimum or maximum Item is not a String,
+// CommonPrefix will panic.
+//
+// O(log(n) + k) where n is the total number of items in the tree and k is the
+// length of the prefix.
+func (t *RedBlackTree) CommonPrefix() string {
+	if t.size == 0 {
+		return ""
+	}
+	min, max := string(t.minNode().item.(String)), string(t.maxNode().item.(String))
+	var i int
+	for i < len(min) && i < len(max) && min[i] == max[i] {
+		i++
+	}
+	return min[:i]
+}
+
+// CountPrefixes returns, for each distinct prefix of 'prefixLen' bytes among
+// the String items in the RedBlackTree, the number of items sharing that
+// prefix. Items shorter than prefixLen are counted by their full value, and a
+// negative prefixLen is treated as zero. If an Item in the tree is not a
+// String, CountPrefixes will panic.
+//
+// O(n) where n is the total number of items in the tree.
+func (t *RedBlackTree) CountPrefixes(prefixLen int) map[string]int {
+	if prefixLen < 0 {
+		prefixLen = 0
+	}
+	counts := make(map[string]int)
+	var prefix string
+	var count int
+	for n := t.minNode(); n != nil; n = n.next() {
+		s := string(n.item.(String))
+		if len(s) > prefixLen {
+			s = s[:prefixLen]
+		}
+		if count > 0 && s != prefix {
+			counts[prefix] += count
+			count = 0
+		}
+		prefix = s
+		count++
+	}
+	if count > 0 {
+		counts[prefix] += count
+	}
+	return counts
+}
+
+// PresenceBitmap returns a slice indicating, for each integer in the inclusive
+// range [lo, hi], whether it is present in the RedBlackTree. Index i of the
+// result corresponds to the integer lo+i. If an Item in the range is not an
+// Int, PresenceBitmap will panic.
+//
+// O(log(n) + m) where n is the total number of items in the tree and m is the
+// size of the range.
+func (t *RedBlackTree) PresenceBitmap(lo, hi Int) []bool {
+	if hi < lo {
+		return nil
+	}
+	bitmap := make([]bool, hi-lo+1)
+	for n := t.root.findGreaterOrEqual(lo); n != nil; n = n.next() {
+		i := n.item.(Int)
+		if i > hi {
+			break
+		}
+		bitmap[i-lo] = true
+	}
+	return bitmap
+}
+
+// Ranges returns the maximal runs of contiguous items in the RedBlackTree as
+// inclusive [start, end] pairs in ascending order. An item is contiguous with
+// its predecessor if it is equal to the result of calling 'next' with the
+// predecessor.
+//
+// O(n) where n is the total number of items in the tree.
+func (t *RedBlackTree) Ranges(next func(Item) Item) [][2]Item {
+	var ranges [][2]Item
+	for n := t.minNode(); n != nil; n = n.next() {
+		if l := len(ranges); l > 0 && equal(next(ranges[l-1][1]), n.item) {
+			ranges[l-1][1] = n.item
+			continue
+		}
+		ranges = append(ranges, [2]Item{n.item, n.item})
+	}
+	return ranges
+}
+
+// AscendRunLengths returns the lengths of the maximal runs of items in the
+// RedBlackTree, in ascending order of the runs, where an item continues the run
+// of its predecessor if 'sameRun' returns 'true' for the pair.
+//
+// O(n) where n is the total number of items in the tree.
+func (t *RedBlackTree) AscendRunLengths(sameRun func(a, b Item) bool) []int {
+	var lengths []int
+	var prev Item
+	for n := t.minNode(); n != nil; n = n.next() {
+		if l := len(lengths); l > 0 && sameRun(prev, n.item) {
+			lengths[l-1]++
+		} else {
+			lengths = append(lengths, 1)
+		}
+		prev = n.item
+	}
+	return lengths
+}
+
+// LevelOrder calls 'fn' for each Item in breadth-first order, starting at the
+// root, along with the depth of the Item in the tree (the root is at level
+// zero), until no Items remain or fn returns 'false'. As LevelOrder exposes the
+// structure of the tree, tombstoned Items in a tree created with
+// NewLazyDelete are included.
+//
+// O(n) where n is the total number of items in the tree.
+func (t *RedBlackTree) LevelOrder(fn func(item Item, level int) bool) {
+	if t.root == nil {
+		return
+	}
+	queue := []*node{t.root}
+	for level := 0; len(queue) > 0; level++ {
+		var next []*node
+		for _, n := range queue {
+			if !fn(n.item, level) {
+				return
+			}
+			if n.left != nil {
+				next = append(next, n.left)
+			}
+			if n.right != nil {
+				next = append(next, n.right)
+			}
+		}
+		queue = next
+	}
+}
+
+// LevelWidths returns the number of items at each level of the RedBlackTree,
+// indexed by depth, where the root is at depth zero. If the tree is empty, an
+// empty slice is returned.
+//
+// In a tree created with NewLazyDelete, tombstoned nodes are not counted, but
+// still occupy their level, so a level may have a width of zero. The widths
+// always sum to Size.
+//
+// O(n) where n is the total number of items in the tree.
+func (t *RedBlackTree) LevelWidths() []int {
+	widths := []int{}
+	if t.size == 0 {
+		return widths
+	}
+	for queue := []*node{t.root}; len(queue) > 0; {
+		var width int
+		var next []*node
+		for _, n := range queue {
+			if !n.dead {
+				width++
+			}
+			if n.left != nil {
+				next = append(next, n.left)
+			}
+			if n.right != nil {
+				next = append(next, n.right)
+			}
+		}
+		widths = append(widths, width)
+		queue = next
+	}
+	return widths
+}
+
+// Edges calls 'fn' for each parent-child edge in the RedBlackTree, along with
+// whether the child is the left child of the parent, until no edges remain or
+// fn returns 'false'. Edges are visited in breadth-first order of their child,
+// with left children before right children. Edges to and from tombstoned
+// nodes in a tree created with NewLazyDelete are included.
+//
+// O(n) where n is the total number of items in the tree.
+func (t *RedBlackTree) Edges(fn func(parent, child Item, isLeft bool) bool) {
+	if t.root == nil {
+		return
+	}
+	queue := []*node{t.root}
+	for len(queue) > 0 {
+		var next []*node
+		for _, n := range queue {
+			if n.left != nil {
+				if !fn(n.item, n.left.item, true) {
+					return
+				}
+				next = append(next, n.left)
+			}
+			if n.right != nil {
+				if !fn(n.item, n.right.item, false) {
+					return
+				}
+				next = append(next, n.right)
+			}
+		}
+		queue = next
+	}
+}
+
+// Histogram returns the number of items in the RedBlackTree greater than or
+// equal to 'lo' and less than or equal to 'hi' in each of 'buckets' buckets,
+// where 'bucketIndex' returns the index of an item's bucket. Items with an
+// index outside of the range [0, buckets) are ignored.
+//
+// O(log(n) + m) where n is the total number of items in the tree and m is the
+// number of items in the range.
+func (t *RedBlackTree) Histogram(lo, hi Item, buckets int, bucketIndex func(item Item) int) []int {
+	counts := make([]int, buckets)
+	for n := t.root.findGreaterOrEqual(lo); n != nil && !hi.Less(n.item); n = n.next() {
+		if i := bucketIndex(n.item); i >= 0 && i < buckets {
+			counts[i]++
+		}
+	}
+	return counts
+}
+
+// CountRanges returns, for each [lo, hi) range provided, the number of items
+// in the RedBlackTree greater than or equal to lo and less than hi. The counts
+// are returned in the same order as the ranges.
+//
+// The range endpoints are sorted and counted in a single pass over the tree,
+// which is more efficient than counting each range separately for large
+// batches of ranges.
+//
+// O(n + m*log(m)) where n is the total number of items in the tree and m is
+// the number of ranges.
+func (t *RedBlackTree) CountRanges(ranges [][2]Item) []int {
+	bounds := make(rangeBounds, 0, 2*len(ranges))
+	for i, r := range ranges {
+		bounds = append(bounds, rangeBound{item: r[0], index: i}, rangeBound{item: r[1], index: i, hi: true})
+	}
+	sort.Sort(bounds)
+
+	counts := make([]int, len(ranges))
+	var rank int
+	n := t.minNode()
+	for _, b := range bounds {
+		for n != nil && n.item.Less(b.item) {
+			n = n.next()
+			rank++
+		}
+		if b.hi {
+			counts[b.index] += rank
+		} else {
+			counts[b.index] -= rank
+		}
+	}
+	for i, count := range counts {
+		if count < 0 {
+			counts[i] = 0
+		}
+	}
+	return counts
+}
+
+// Delete deletes an item in the RedBlackTree equal to the provided
+// item. If an item was deleted, it is returned. Otherwise, nil is returned.
+//
+// Note: equality for items a & b is: (!a.Less(b) && !b.Less(a)).
+//
+// O(log(n))
+func (t *RedBlackTree) Delete(item Item) Item {
+	item, _ = t.DeleteOK(item)
+	return item
+}
+
+// DeleteOK deletes an item in the RedBlackTree equal to the provided item,
+// returning it and 'true'. If no equal item exists, nil and 'false' are
+// returned.
+//
+// Note: equality for items a & b is: (!a.Less(b) && !b.Less(a)).
+//
+// O(log(n))
+func (t *RedBlackTree) DeleteOK(item Item) (Item, bool) {
+	if t.root == nil {
+		return nil, false
+	}
+	return t.root.deleteItem(t, item)
+}
+
+// DeleteMax deletes the maximum item in the RedBlackTree, returning
+// it. If the tree is empty, nil is returned.
+//
+// O(log(n))
+func (t *RedBlackTree) DeleteMax() Item {
+	n := t.maxNode()
+	if n == nil {
+		return nil
+	}
+	return n.deleteNode(t)
+}
+
+// DeleteMin deletes the minimum item in the RedBlackTree, returning
+// it. If the tree is empty, nil is returned.
+//
+// O(log(n))
+func (t *RedBlackTree) DeleteMin() Item {
+	n := t.minNode()
+	if n == nil {
+		return nil
+	}
+	return n.deleteNode(t)
+}
+
+// PopNearest deletes the item in the RedBlackTree nearest to the provided
+// item, returning it. The nearest item is chosen between the largest item less
+// than or equal to, and the smallest item greater than or equal to, the
+// provided item using the distance function 'dist'. Ties favour the smaller
+// item. If the tree is empty, nil is returned.
+//
+// O(log(n))
+func (t *RedBlackTree) PopNearest(item Item, dist func(a, b Item) float64) Item {
+	lower, upper := t.root.bracket(item)
+	n := lower
+	switch {
+	case lower == nil:
+		n = upper
+	case upper != nil && dist(item, upper.item) < dist(item, lower.item):
+		n = upper
+	}
+	if n == nil {
+		return nil
+	}
+	return n.deleteNode(t)
+}
+
+// FirstOrderingViolation returns the first pair of adjacent items in the
+// RedBlackTree where 'a' is not less than 'b', along with 'true'. If the
+// items are correctly ordered, 'false' is returned.
+//
+// A violation indicates either an inconsistent Less method, or that an item's
+// key was modified after it was inserted into the tree.
+//
+// O(n) where n is the total number of items in the tree.
+func (t *RedBlackTree) FirstOrderingViolation() (a, b Item, ok bool) {
+	n := t.minNode()
+	if n == nil {
+		return nil, nil, false
+	}
+	for next := n.next(); next != nil; n, next = next, next.next() {
+		if !n.item.Less(next.item) {
+			return n.item, next.item, true
+		}
+	}
+	return nil, nil, false
+}
+
+// AdvanceWindow upserts 'newItem' and, if the RedBlackTree then holds more
+// than 'maxSize' items, deletes and returns the minimum item. The minimum item
+// is treated as the oldest, so items should be ordered by insertion time (e.g.
+// a sequence number or timestamp) to maintain a sliding window of the most
+// recent items. If no item is evicted, nil is returned.
+//
+// O(log(n))
+func (t *RedBlackTree) AdvanceWindow(newItem Item, maxSize int) Item {
+	t.Upsert(newItem)
+	if t.size <= maxSize {
+		return nil
+	}
+	return t.DeleteMin()
+}
+
+// IsSortedBy returns 'true' if the items of the RedBlackTree, in their current
+// order, are in strictly ascending order according to 'less'. This verifies
+// that the tree would remain a valid binary search tree, with no equal items,
+// under a different ordering.
+//
+// O(n) where n is the total number of items in the tree.
+func (t *RedBlackTree) IsSortedBy(less func(a, b Item) bool) bool {
+	n := t.minNode()
+	if n == nil {
+		return true
+	}
+	for next := n.next(); next != nil; n, next = next, next.next() {
+		if !less(n.item, next.item) {
+			return false
+		}
+	}
+	return true
+}
+
+// DeleteMinUntil repeatedly deletes the minimum item in the RedBlackTree while
+// it is less than 'bound', returning the deleted items in ascending order.
+//
+// O(m*log(n)) where n is the total number of items in the tree and m is the
+// number of items deleted.
+func (t *RedBlackTree) DeleteMinUntil(bound Item) []Item {
+	var items []Item
+	for n := t.minNode(); n != nil && n.item.Less(bound); n = t.minNode() {
+		items = append(items, n.deleteNode(t))
+	}
+	return items
+}
+
+// DrainRange calls 'fn' for each Item greater or equal to 'lo' and less than
+// 'hi' in ascending order, deleting each Item from the RedBlackTree after fn
+// returns. If fn returns 'false', the Item it was called with is deleted and
+// all remaining Items in the range are left in the tree.
+//
+// O(m*log(n)) where n is the total number of items in the tree and m is the
+// number of items drained.
+func (t *RedBlackTree) DrainRange(lo, hi Item, fn func(Item) bool) {
+	n := t.root.findGreaterOrEqual(lo)
+	for n != nil && n.item.Less(hi) {
+		ok := fn(n.item)
+		n, _ = n.deleteAndNext(t)
+		if !ok {
+			return
+		}
+	}
+}
+
+// Get retrieves an item in the RedBlackTree equal to the provided
+// item. If an item was found, it is returned. Otherwise, nil is returned.
+//
+// Note: equality for items a & b is: (!a.Less(b) && !b.Less(a)).
+//
+// O(log(n))
+func (t *RedBlackTree) Get(item Item) Item {
+	n := t.root.find(item)
+	if n == nil {
+		return nil
+	}
+	if t.tracking {
+		atomic.AddUint64(t.accesses[n], 1)
+	}
+	return n.item
+}
+
+// Canonicalize returns the item in the RedBlackTree equal to the provided item,
+// if one exists. Otherwise, the provided item is upserted and returned. This
+// allows many equal items to be replaced by a single, canonical instance.
+//
+// Like Upsert, Canonicalize panics if the item cannot be inserted.
+//
+// Note: equality for items a & b is: (!a.Less(b) && !b.Less(a)).
+//
+// O(log(n))
+func (t *RedBlackTree) Canonicalize(item Item) Item {
+	if stored := t.Get(item); stored != nil {
+		return stored
+	}
+	t.Upsert(item)
+	return item
+}
+
+// TryGet is like Get, but returns ErrNotFound if no item equal to the provided
+// item exists in the RedBlackTree.
+//
+// O(log(n))
+func (t *RedBlackTree) TryGet(item Item) (Item, error) {
+	if found := t.Get(item); found != nil {
+		return found, nil
+	}
+	return nil, ErrNotFound
+}
+
+// GetByKey retrieves the item in the RedBlackTree matching the provided key,
+// without needing to construct an Item. The function 'compare' must return a
+// negative number if the key is less than the item, a positive number if the
+// key is greater than the item, and zero if they are equal, consistent with
+// the ordering of the items' Less method. If no item matches, nil is
+// returned.
+//
+// O(log(n))
+func (t *RedBlackTree) GetByKey(key interface{}, compare func(key interface{}, item Item) int) Item {
+	n := t.root
+	for n != nil {
+		switch c := compare(key, n.item); {
+		case c < 0:
+			n = n.left
+		case c > 0:
+			n = n.right
+		case n.dead:
+			return nil
+		default:
+			return n.item
+		}
+	}
+	return nil
+}
+
+// GetWithPosition retrieves an item in the RedBlackTree equal to the provided
+// item, along with whether it is currently the minimum and/or maximum item in
+// the tree. If no item was found, nil and 'false' for both flags are returned.
+//
+// Note: equality for items a & b is: (!a.Less(b) && !b.Less(a)).
+//
+// O(log(n))
+func (t *RedBlackTree) GetWithPosition(item Item) (stored Item, isMin, isMax bool) {
+	n := t.root.find(item)
+	if n == nil {
+		return nil, false, false
+	}
+	return n.item, n.prev() == nil, n.next() == nil
+}
+
+// ItemAtFraction returns the item at rank floor(f * (Size() - 1)) in the
+// RedBlackTree, where 'f' is clamped to the range [0, 1]. Therefore,
+// ItemAtFraction(0) returns the minimum item and ItemAtFraction(1) returns the
+// maximum item. If the tree is empty, nil is returned.
+//
+// The item is found by walking from whichever end of the tree is closer to
+// the rank, so ItemAtFraction is linear rather than logarithmic in the size
+// of the tree.
+//
+// O(log(n) + n/2) where n is the total number of items in the tree.
+func (t *RedBlackTree) ItemAtFraction(f float64) Item {
+	if t.size == 0 {
+		return nil
+	}
+	if f < 0 {
+		f = 0
+	} else if f > 1 {
+		f = 1
+	}
+	return t.nodeAtRank(int(f * float64(t.size-1))).item
+}
+
+// OptimizeLayout rearranges the nodes of the RedBlackTree into a single
+// contiguous block of memory in a van Emde Boas order, where each subtree is
+// stored close together. This cache-oblivious layout reduces cache misses
+// when searching large trees. The items and the structure of the tree are not
+// changed.
+//
+// OptimizeLayout is intended for trees that are no longer modified. Nodes
+// created by subsequent writes are allocated outside of the optimized block,
+// and the block is retained in memory until none of its nodes remain in use.
+//
+// O(n*log(log(n))) where n is the total number of items in the tree.
+func (t *RedBlackTree) OptimizeLayout() {
+	if t.root == nil {
+		return
+	}
+	order := vebOrder(t.root, t.root.height(), make([]*node, 0, t.size))
+
+	block := make([]node, len(order))
+	for i, n := range order {
+		block[i] = *n
+	}
+	// Use the parent pointer of each old node to forward to its new
+	// location.
+	for i, n := range order {
+		t.moveState(n, &block[i])
+		n.parent = &block[i]
+	}
+	t.root = t.root.parent
+	if t.finger != nil {
+		t.finger = t.finger.parent
+	}
+	t.bumpVersion()
+	for i := range block {
+		n := &block[i]
+		if n.parent != nil {
+			n.parent = n.parent.parent
+		}
+		if n.left != nil {
+			n.left = n.left.parent
+		}
+		if n.right != nil {
+			n.right = n.right.parent
+		}
+	}
+}
+
+// vebOrder appends the nodes of the subtree rooted at 'n', truncated to the
+// provided height, in van Emde Boas order.
+func vebOrder(n *node, height int, order []*node) []*node {
+	if n == nil {
+		return order
+	}
+	if height == 1 {
+		return append(order, n)
+	}
+	top := height / 2
+	order = vebOrder(n, top, order)
+	for _, bottom := range n.nodesAtDepth(top, nil) {
+		order = vebOrder(bottom, height-top, order)
+	}
+	return order
+}
+
+// PathToRoot returns the items on the path from the item in the RedBlackTree
+// equal to the provided item up to the root of the tree, inclusive. If no
+// equal item exists, nil is returned.
+//
+// O(log(n))
+func (t *RedBlackTree) PathToRoot(item Item) []Item {
+	var path []Item
+	for n := t.root.find(item); n != nil; n = n.parent {
+		path = append(path, n.item)
+	}
+	return path
+}
+
+// RetainIf deletes every item in the RedBlackTree for which 'fn' returns
+// 'false', returning the number of items deleted. Rather than deleting items
+// individually, the remaining items are rebuilt into a balanced tree, making
+// RetainIf more efficient than repeated calls to Delete when many items are
+// removed.
+//
+// O(n) where n is the total number of items in the tree.
+func (t *RedBlackTree) RetainIf(fn func(Item) bool) int {
+	var keep, removed []*node
+	for n := t.minNode(); n != nil; n = n.next() {
+		if fn(n.item) {
+			keep = append(keep, n)
+		} else {
+			removed = append(removed, n)
+		}
+	}
+	if len(removed) == 0 {
+		return 0
+	}
+	t.rebuild(keep)
+	for _, n := range removed {
+		item := n.item
+		t.freeNode(n)
+		if t.onDelete != nil {
+			t.onDelete(item)
+		}
+	}
+	return len(removed)
+}
+
+// Map replaces every item in the RedBlackTree with the result of calling
+// 'transform' with it, returning the number of items whose transformed item is
+// not equal to the original. As transformed items may be ordered differently,
+// the tree is rebuilt from the sorted transformed items. If multiple items are
+// transformed into equal items, only the one transformed from the smallest
+// original item is kept.
+//
+// Map panics with ErrOutOfRange, before modifying the tree, if any transformed
+// item is outside of the range of a tree created with NewBounded.
+//
+// Note: equality for items a & b is: (!a.Less(b) && !b.Less(a)).
+//
+// O(n*log(n)) where n is the total number of items in the tree.
+func (t *RedBlackTree) Map(transform func(Item) Item) int {
+	m := mappedNodes{nodes: make([]*node, 0, t.size)}
+	for n := t.minNode(); n != nil; n = n.next() {
+		m.nodes = append(m.nodes, n)
+	}
+	m.items = make([]Item, len(m.nodes))
+	var changed int
+	for i, n := range m.nodes {
+		item := transform(n.item)
+		if t.lo != nil && (item.Less(t.lo) || !item.Less(t.hi)) {
+			panic(ErrOutOfRange)
+		}
+		if !equal(item, n.item) {
+			changed++
+		}
+		m.items[i] = item
+	}
+
+	// Store the transformed items, keeping the originals for the hooks.
+	for i, n := range m.nodes {
+		m.items[i], n.item = n.item, m.items[i]
+	}
+	sort.Stable(m)
+	var removed itemSlice
+	keep := 0
+	for i, n := range m.nodes {
+		if keep > 0 && !m.nodes[keep-1].item.Less(n.item) {
+			// Report the original item, rather than the transformed item
+			// that is equal to one kept in the tree.
+			removed = append(removed, m.items[i])
+			t.freeNode(n)
+			continue
+		}
+		m.nodes[keep], m.items[keep] = n, m.items[i]
+		keep++
+	}
+	t.rebuild(m.nodes[:keep])
+
+	if t.onDelete != nil {
+		sort.Stable(removed)
+		for _, item := range removed {
+			t.onDelete(item)
+		}
+	}
+	if t.onInsert != nil {
+		for i, n := range m.nodes[:keep] {
+			t.onInsert(n.item, m.items[i])
+		}
+	}
+	return changed
+}
+
+// mappedNodes sorts nodes by item, along with the items they held before
+// being mapped.
+type mappedNodes struct {
+	nodes []*node
+	items []Item
+}
+
+func (m mappedNodes) Len() int { return len(m.nodes) }
+func (m mappedNodes) Swap(i, j int) {
+	m.nodes[i], m.nodes[j] = m.nodes[j], m.nodes[i]
+	m.items[i], m.items[j] = m.items[j], m.items[i]
+}
+func (m mappedNodes) Less(i, j int) bool {
+	return m.nodes[i].item.Less(m.nodes[j].item)
+}
+
+// Coalesce walks the RedBlackTree in ascending order and, whenever
+// 'canMerge' returns 'true' for a pair of adjacent items, replaces them with
+// the result of calling 'merge' with them, until no adjacent pair of items can
+// be merged. The number of merges performed is returned.
+//
+// The merged item need not be ordered between the pair. However, a pair is
+// left unmerged if its merged item is equal to another item in the tree,
+// rather than replacing that item, or if the merged item cannot be inserted,
+// such as if it is outside of the range of a tree created with NewBounded.
+// Neither item of the pair is removed until the merged item is in the tree.
+//
+// O(n + m*log(n)) where n is the total number of items in the tree and m is
+// the number of merges performed, if each merged item is ordered between the
+// neighbours of its pair. Otherwise, each merge may re-check up to n pairs.
+func (t *RedBlackTree) Coalesce(canMerge func(a, b Item) bool, merge func(a, b Item) Item) int {
+	var merges int
+	n := t.minNode()
+	for n != nil {
+		next := n.next()
+		if next == nil || !canMerge(n.item, next.item) {
+			n = next
+			continue
+		}
+		a, b := n.item, next.item
+		merged := merge(a, b)
+		var before Item
+		if prev := n.prev(); prev != nil {
+			before = prev.item
+		}
+		switch {
+		case equal(merged, a) || equal(merged, b):
+			// The merged item takes the place of the equal item in the
+			// pair, before the other item is deleted.
+			keep, drop := n, b
+			if !equal(merged, a) {
+				keep, drop = next, a
+			}
+			old := keep.item
+			keep.item = merged
+			t.bumpVersion()
+			if t.onInsert != nil {
+				t.onInsert(merged, old)
+			}
+			t.Delete(drop)
+		case t.root.find(merged) != nil:
+			n = next
+			continue
+		default:
+			if _, err := t.TryUpsert(merged); err != nil {
+				n = next
+				continue
+			}
+			t.Delete(a)
+			t.Delete(b)
+		}
+		merges++
+
+		// Resume at the first pair that may have changed: either the
+		// merged item's new predecessor, or the pair's old predecessor,
+		// which is now adjacent to the pair's old successor.
+		n = t.root.find(merged)
+		if prev := n.prev(); prev != nil {
+			n = prev
+		}
+		if before != nil && before.Less(n.item) {
+			n = t.root.find(before)
+		}
+	}
+	return merges
+}
+
+// Compact removes every tombstone from a RedBlackTree created with
+// NewLazyDelete, rebuilding the remaining items into a balanced tree, and
+// returns the number of tombstones removed.
+//
+// O(n) where n is the total number of items and tombstones in the tree.
+func (t *RedBlackTree) Compact() int {
+	if t.tombstones == 0 {
+		return 0
+	}
+	live := make([]*node, 0, t.size)
+	dead := make([]*node, 0, t.tombstones)
+	for n := t.root.min(); n != nil; n = n.successor() {
+		if n.dead {
+			dead = append(dead, n)
+		} else {
+			live = append(live, n)
+		}
+	}
+	t.rebuild(live)
+	for _, n := range dead {
+		t.freeNode(n)
+	}
+	return len(dead)
+}
+
+// HotKeys returns up to 'n' of the most frequently accessed items in the
+// RedBlackTree, ordered from most to least accessed. Items with equal access
+// counts are ordered ascending. Items that have not been accessed are not
+// returned, nor are any items if the tree was not created with NewTracking.
+//
+// O(n*log(n)) where n is the total number of items in the tree.
+func (t *RedBlackTree) HotKeys(n int) []Item {
+	if !t.tracking || n <= 0 {
+		return nil
+	}
+	var hot hotNodes
+	for nd := t.minNode(); nd != nil; nd = nd.next() {
+		if atomic.LoadUint64(t.accesses[nd]) > 0 {
+			hot = append(hot, hotNode{nd, t.accesses[nd]})
+		}
+	}
+	sort.Stable(hot)
+	if len(hot) > n {
+		hot = hot[:n]
+	}
+	items := make([]Item, len(hot))
+	for i, h := range hot {
+		items[i] = h.n.item
+	}
+	return items
+}
+
+// LastInsertRotations returns the number of rotations performed to rebalance
+// the RedBlackTree by the most recent upsert, which is at most two. If the tree
+// was not created with NewTracking, zero is returned.
+//
+// O(1)
+func (t *RedBlackTree) LastInsertRotations() int {
+	if !t.tracking {
+		return 0
+	}
+	return t.lastRotations
+}
+
+// ResetAccessCounts resets the access count of every item in the RedBlackTree
+// to zero.
+//
+// O(n) where n is the total number of items in the tree.
+func (t *RedBlackTree) ResetAccessCounts() {
+	for _, count := range t.accesses {
+		atomic.StoreUint64(count, 0)
+	}
+}
+
+// SingleInRange returns the only item greater than or equal to 'lo' and less
+// than 'hi' in the RedBlackTree, along with 'true'. If there are no items, or
+// more than one item, in the range, nil and 'false' are returned.
+//
+// O(log(n))
+func (t *RedBlackTree) SingleInRange(lo, hi Item) (Item, bool) {
+	n := t.root.findGreaterOrEqual(lo)
+	if n == nil || !n.item.Less(hi) {
+		return nil, false
+	}
+	if next := n.next(); next != nil && next.item.Less(hi) {
+		return nil, false
+	}
+	return n.item, true
+}
+
+// WindowByRank returns the items with zero-based ranks in the inclusive range
+// [center-radius, center+radius] in ascending order. The range is clamped to
+// the ranks present in the RedBlackTree.
+//
+// The start of the window is found by walking from the nearer end of the tree
+// rather than by an order-statistic select, as the tree does not maintain
+// subtree sizes.
+//
+// O(n/2 + m) where n is the total number of items in the tree and m is the
+// size of the window.
+func (t *RedBlackTree) WindowByRank(center, radius int) []Item {
+	lo, hi := center-radius, center+radius
+	if lo < 0 {
+		lo = 0
+	}
+	if hi >= t.size {
+		hi = t.size - 1
+	}
+	if lo > hi {
+		return nil
+	}
+	items := make([]Item, 0, hi-lo+1)
+	for n := t.nodeAtRank(lo); len(items) < cap(items); n = n.next() {
+		items = append(items, n.item)
+	}
+	return items
+}
+
+// WidestGaps returns up to 'k' pairs of adjacent items in the RedBlackTree
+// with the largest gaps between them, as computed by 'gap', ordered by
+// descending gap. Pairs with equal gaps are ordered ascending.
+//
+// O(n*log(k)) where n is the total number of items in the tree.
+func (t *RedBlackTree) WidestGaps(k int, gap func(a, b Item) float64) [][2]Item {
+	if k <= 0 {
+		return nil
+	}
+	h := make(gapHeap, 0, k)
+	var pos int
+	for n := t.minNode(); n != nil; n = n.next() {
+		next := n.next()
+		if next == nil {
+			break
+		}
+		g := itemGap{pair: [2]Item{n.item, next.item}, gap: gap(n.item, next.item), pos: pos}
+		pos++
+		if len(h) < k {
+			heap.Push(&h, g)
+		} else if h.less(h[0], g) {
+			h[0] = g
+			heap.Fix(&h, 0)
+		}
+	}
+
+	pairs := make([][2]Item, len(h))
+	for i := len(h) - 1; i >= 0; i-- {
+		pairs[i] = heap.Pop(&h).(itemGap).pair
+	}
+	return pairs
+}
+
+// SubTree returns a new, balanced RedBlackTree containing the items in the
+// RedBlackTree greater than or equal to 'lo' and less than 'hi'. The source
+// tree is not modified, and the two trees are independent of each other.
+//
+// O(log(n) + m) where n is the total number of items in the tree and m is the
+// number of items in the range.
+func (t *RedBlackTree) SubTree(lo, hi Item) *RedBlackTree {
+	var items []Item
+	t.AscendRange(lo, hi, func(item Item) bool {
+		items = append(items, item)
+		return true
+	})
+	return buildTree(items)
+}
+
+// Downsample returns a new, balanced RedBlackTree containing every n-th item
+// in the RedBlackTree by rank, starting with the minimum item. The source tree
+// is not modified, and the two trees are independent of each other.
+//
+// Downsample panics if n is not positive.
+//
+// O(n) where n is the total number of items in the tree.
+func (t *RedBlackTree) Downsample(n int) *RedBlackTree {
+	if n <= 0 {
+		panic("tree: downsample interval must be positive")
+	}
+	items := make([]Item, 0, (t.size+n-1)/n)
+	var rank int
+	for nd := t.minNode(); nd != nil; nd = nd.next() {
+		if rank%n == 0 {
+			items = append(items, nd.item)
+		}
+		rank++
+	}
+	return buildTree(items)
+}
+
+// SplitN splits the items in the RedBlackTree into 'n' new, balanced
+// RedBlackTrees, each containing a contiguous range of items by rank. The
+// sizes of the returned trees differ by at most one, with any larger trees
+// first. The source tree is not modified, and the trees are independent of
+// each other.
+//
+// SplitN panics if n is not positive.
+//
+// O(n) where n is the total number of items in the tree.
+func (t *RedBlackTree) SplitN(n int) []*RedBlackTree {
+	if n <= 0 {
+		panic("tree: split count must be positive")
+	}
+	items := make([]Item, 0, t.size)
+	for nd := t.minNode(); nd != nil; nd = nd.next() {
+		items = append(items, nd.item)
+	}
+	parts := make([]*RedBlackTree, n)
+	size, rem := len(items)/n, len(items)%n
+	for i := range parts {
+		end := size
+		if i < rem {
+			end++
+		}
+		parts[i] = buildTree(items[:end:end])
+		items = items[end:]
+	}
+	return parts
+}
+
+// SubtreeSizeHistogram returns a histogram of the sizes of the subtrees rooted
+// at each node in the RedBlackTree, mapping each subtree size to the number of
+// nodes with a subtree of that size. The root's subtree contains every item.
+// Subtree sizes are not stored in the tree, so they are counted in a single
+// post-order traversal.
+//
+// In a tree created with NewLazyDelete, only the items of each subtree are
+// counted, and tombstoned nodes have no entry, so the counts always sum to
+// Size.
+//
+// O(n) where n is the total number of items in the tree.
+func (t *RedBlackTree) SubtreeSizeHistogram() map[int]int {
+	hist := make(map[int]int)
+	t.root.subtreeSizes(hist)
+	return hist
+}
+
+func (n *node) subtreeSizes(hist map[int]int) int {
+	if n == nil {
+		return 0
+	}
+	size := n.left.subtreeSizes(hist) + n.right.subtreeSizes(hist)
+	if n.dead {
+		return size
+	}
+	size++
+	hist[size]++
+	return size
+}
+
+// Upsert inserts (or replaces) an item into the RedBlackTree. If an
+// item was replaced, it is returned. Otherwise, nil is returned.
+//
+// If the tree was created with NewAggregating, an existing item is replaced by
+// the result of the tree's combine function, and the existing item is
+// returned. If the tree was created with NewInsertOnce, an existing item is
+// left in place and returned.
+//
+// Upsert panics if the item cannot be inserted, such as an item outside of the
+// range of a tree created with NewBounded. Use TryUpsert to receive an error
+// instead.
+//
+// Note: equality for items a & b is: (!a.Less(b) && !b.Less(a)).
+//
+// O(log(n))
+func (t *RedBlackTree) Upsert(item Item) Item {
+	oldItem, err := t.TryUpsert(item)
+	if err != nil {
+		panic(err)
+	}
+	return oldItem
+}
+
+// TryUpsert is like Upsert, but returns an error if the item cannot be
+// inserted. ErrOutOfRange is returned for an item outside of the range of a
+// tree created with NewBounded, and ErrMaxHeight is returned if inserting the
+// item would exceed the height set with SetMaxHeight.
+//
+// O(log(n))
+func (t *RedBlackTree) TryUpsert(item Item) (Item, error) {
+	return t.upsertFrom(t.root, item)
+}
+
+// UpsertNear is like Upsert, but uses 'hint' to reduce the number of
+// comparisons required for clustered upserts.
+//
+// The hint is only used if it is equal to the item most recently upserted
+// into the tree, whose node is remembered. In that case, the search for the
+// item's position starts from that node, climbing only as far up the tree as
+// required. Any other hint is ignored, and the search starts from the root, as
+// with Upsert, since locating an arbitrary hint would itself require a search
+// from the root. UpsertNear is therefore suited to sequences of upserts where
+// each item is near the previous one.
+//
+// Note: equality for items a & b is: (!a.Less(b) && !b.Less(a)).
+//
+// O(log(d)) where d is the distance between the previously upserted item and
+// the item, if the hint is equal to the previously upserted item. Otherwise,
+// O(log(n)).
+func (t *RedBlackTree) UpsertNear(hint, item Item) Item {
+	start := t.root
+	if t.finger != nil && equal(t.finger.item, hint) {
+		start = t.finger.climb(item)
+	}
+	oldItem, err := t.upsertFrom(start, item)
+	if err != nil {
+		panic(err)
+	}
+	return oldItem
+}
+
+// upsertFrom upserts the item, searching for its position from the provided
+// node, whose subtree must contain that position.
+func (t *RedBlackTree) upsertFrom(start *node, item Item) (Item, error) {
+	if t.lo != nil && (item.Less(t.lo) || !item.Less(t.hi)) {
+		return nil, ErrOutOfRange
+	}
+	var oldItem Item
+	t.lastRotations = 0
+	if t.root == nil {
+		t.root = t.newNode(nil, item)
+		t.root.colour = colourBlack
+		t.size++
+		t.finger = t.root
+	} else if n, inserted := start.insert(t, item); inserted {
+		if t.maxHeight > 0 && n.depth() >= t.maxHeight {
+			// Detach the new leaf before rebalancing.
+			n.replaceNode(t, nil)
+			t.freeNode(n)
+			return nil, ErrMaxHeight
+		}
+		t.size++
+		t.finger = n
+		t.lastRotations = n.rebalanceInsert(t)
+	} else if n.dead {
+		// Reuse the tombstoned node as a newly inserted item.
+		n.dead = false
+		n.item = item
+		if t.tracking {
+			atomic.StoreUint64(t.accesses[n], 0)
+		}
+		if t.ids != nil {
+			t.lastID++
+			t.ids[n] = t.lastID
+		}
+		t.size++
+		t.tombstones--
+		t.finger = n
+	} else {
+		t.finger = n
+		oldItem = n.item
+		var replaced bool
+		if item, replaced = t.replace(n, item); !replaced {
+			return oldItem, nil
+		}
+	}
+	t.bumpVersion()
+	if t.onInsert != nil {
+		t.onInsert(item, oldItem)
+	}
+	return oldItem, nil
+}
+
+// replace stores 'item' in the node, which holds an equal item, according to
+// the upsert behaviour of the RedBlackTree. The stored item is returned, along
+// with 'false' if the node was left unchanged.
+func (t *RedBlackTree) replace(n *node, item Item) (Item, bool) {
+	if t.insertOnce {
+		return nil, false
+	}
+	if t.combine != nil {
+		item = t.combine(n.item, item)
+	}
+	n.item = item
+	return item, true
+}
+
+// MergeSorted upserts the provided items, which must be sorted in ascending
+// order with no duplicates, into the RedBlackTree, returning the number of
+// items that were not already present. Equal items are handled as by Upsert,
+// and MergeSorted panics with ErrOutOfRange, before modifying the tree, if any
+// item is outside of the range of a tree created with NewBounded.
+//
+// MergeSorted is not atomic with respect to the height set with SetMaxHeight:
+// if upserting an item fails with ErrMaxHeight, MergeSorted panics, leaving
+// the items before it in the tree.
+//
+// If the number of items is small relative to the size of the tree, they are
+// upserted individually in O(m*log(n)). Otherwise, specifically when
+// m*log2(n+m) >= n+m, the items are merged with the existing items in a single
+// pass and the tree is rebuilt in O(n+m).
+func (t *RedBlackTree) MergeSorted(items []Item) int {
+	if len(items) == 0 {
+		return 0
+	}
+	if t.lo != nil && (items[0].Less(t.lo) || !items[len(items)-1].Less(t.hi)) {
+		panic(ErrOutOfRange)
+	}
+
+	total := t.size + len(items)
+	var log int
+	for n := total; n > 0; n >>= 1 {
+		log++
+	}
+	if len(items)*log < total {
+		size := t.size
+		for _, item := range items {
+			t.Upsert(item)
+		}
+		return t.size - size
+	}
+
+	type upsert struct {
+		item, replaced Item
+	}
+	var upserts []upsert
+	nodes := make([]*node, 0, total)
+	n := t.minNode()
+	for _, item := range items {
+		for n != nil && n.item.Less(item) {
+			nodes = append(nodes, n)
+			n = n.next()
+		}
+		if n != nil && !item.Less(n.item) {
+			oldItem := n.item
+			if stored, replaced := t.replace(n, item); replaced {
+				upserts = append(upserts, upsert{stored, oldItem})
+			}
+			nodes = append(nodes, n)
+			n = n.next()
+			continue
+		}
+		nodes = append(nodes, t.newNode(nil, item))
+		upserts = append(upserts, upsert{item, nil})
+	}
+	for ; n != nil; n = n.next() {
+		nodes = append(nodes, n)
+	}
+
+	added := len(nodes) - t.size
+	t.rebuild(nodes)
+	t.lastRotations = 0
+	if t.onInsert != nil {
+		for _, u := range upserts {
+			t.onInsert(u.item, u.replaced)
+		}
+	}
+	return added
+}
+
+// Bracket returns the largest item less than or equal to, and the smallest
+// item greater than or equal to, the provided item in a single descent of the
+// RedBlackTree. Either may be nil if no such item exists. If an equal item is
+// present, it is returned as both 'lower' and 'upper'.
+//
+// O(log(n))
+func (t *RedBlackTree) Bracket(item Item) (lower, upper Item) {
+	lo, hi := t.root.bracket(item)
+	if lo != nil {
+		lower = lo.item
+	}
+	if hi != nil {
+		upper = hi.item
+	}
+	return lower, upper
+}
+
+// NthFrom returns the item 'n' positions after the smallest item greater than
+// or equal to 'start', or before it if n is negative. If there is no item
+// greater than or equal to start, or the position is outside of the tree, nil
+// is returned.
+//
+// O(log(n) + |n|)
+func (t *RedBlackTree) NthFrom(start Item, n int) Item {
+	nd := t.root.findGreaterOrEqual(start)
+	for ; nd != nil && n > 0; n-- {
+		nd = nd.next()
+	}
+	for ; nd != nil && n < 0; n++ {
+		nd = nd.prev()
+	}
+	if nd == nil {
+		return nil
+	}
+	return nd.item
+}
+
+// NearestBoth returns the largest item less than or equal to, and the smallest
+// item greater than or equal to, the provided item, along with their distances
+// from it as measured by 'dist'. If either item does not exist, it is returned
+// as nil with a distance of positive infinity.
+//
+// O(log(n))
+func (t *RedBlackTree) NearestBoth(item Item, dist func(a, b Item) float64) (below Item, belowDist float64, above Item, aboveDist float64) {
+	belowDist, aboveDist = math.Inf(1), math.Inf(1)
+	lower, upper := t.root.bracket(item)
+	if lower != nil {
+		below, belowDist = lower.item, dist(item, lower.item)
+	}
+	if upper != nil {
+		above, aboveDist = upper.item, dist(item, upper.item)
+	}
+	return below, belowDist, above, aboveDist
+}
+
+// Exists returns 'true' if an item equal to the provided item
+// exists in the RedBlackTree.
+//
+// Note: equality for items a & b is: (!a.Less(b) && !b.Less(a)).
+//
+// O(log(n))
+func (t *RedBlackTree) Exists(item Item) bool {
+	return t.Get(item) != nil
+}
+
+// ShuffledSlice returns all items in the RedBlackTree in a random order,
+// produced by a Fisher-Yates shuffle using the provided source of randomness.
+// The order is reproducible for a given seed of 'rng' and tree contents.
+//
+// O(n) where n is the total number of items in the tree.
+func (t *RedBlackTree) ShuffledSlice(rng *rand.Rand) []Item {
+	items := make([]Item, 0, t.size)
+	for n := t.minNode(); n != nil; n = n.next() {
+		items = append(items, n.item)
+	}
+	for i := len(items) - 1; i > 0; i-- {
+		j := rng.Intn(i + 1)
+		items[i], items[j] = items[j], items[i]
+	}
+	return items
+}
+
+// EqualsSlice returns 'true' if an in-order traversal of the RedBlackTree
+// yields exactly the provided items, with each pair being equal.
+//
+// Note: equality for items a & b is: (!a.Less(b) && !b.Less(a)).
+//
+// O(n) where n is the total number of items in the tree.
+func (t *RedBlackTree) EqualsSlice(items []Item) bool {
+	if len(items) != t.size {
+		return false
+	}
+	n := t.minNode()
+	for _, item := range items {
+		if !equal(n.item, item) {
+			return false
+		}
+		n = n.next()
+	}
+	return true
+}
+
+// MissingKeys returns the items in 'expected', which must be sorted in
+// ascending order, that have no equal item in the RedBlackTree. The missing
+// items are returned in ascending order.
+//
+// O(n + m) where n is the total number of items in the tree and m is the
+// number of expected items.
+func (t *RedBlackTree) MissingKeys(expected []Item) []Item {
+	var missing []Item
+	n := t.minNode()
+	for _, item := range expected {
+		for n != nil && n.item.Less(item) {
+			n = n.next()
+		}
+		if n == nil || item.Less(n.item) {
+			missing = append(missing, item)
+		}
+	}
+	return missing
+}
+
+// EqualStreaming walks the RedBlackTree and 'other' in ascending order,
+// returning 'true' if they contain equal items. If 'onDiff' is not nil, it is
+// called in ascending order for each item present in only one of the trees,
+// with 'side' set to -1 for an item in this tree and +1 for an item in other.
+//
+// O(n + m) where n and m are the number of items in each tree.
+func (t *RedBlackTree) EqualStreaming(other *RedBlackTree, onDiff func(item Item, side int)) bool {
+	eq := true
+	diff := func(n *node, side int) *node {
+		eq = false
+		if onDiff != nil {
+			onDiff(n.item, side)
+		}
+		return n.next()
+	}
+	an, bn := t.minNode(), other.minNode()
+	for an != nil && bn != nil {
+		switch {
+		case an.item.Less(bn.item):
+			an = diff(an, -1)
+		case bn.item.Less(an.item):
+			bn = diff(bn, 1)
+		default:
+			an, bn = an.next(), bn.next()
+		}
+	}
+	for an != nil {
+		an = diff(an, -1)
+	}
+	for bn != nil {
+		bn = diff(bn, 1)
+	}
+	return eq
+}
+
+// UnionSizeEstimate returns the number of distinct items in the union of the
+// RedBlackTree and 'other', without building the union. Despite its name, the
+// returned size is exact.
+//
+// O(n + m) where n and m are the number of items in each tree.
+func (t *RedBlackTree) UnionSizeEstimate(other *RedBlackTree) int {
+	size := t.size + other.size
+	an, bn := t.minNode(), other.minNode()
+	for an != nil && bn != nil {
+		switch {
+		case an.item.Less(bn.item):
+			an = an.next()
+		case bn.item.Less(an.item):
+			bn = bn.next()
+		default:
+			size--
+			an, bn = an.next(), bn.next()
+		}
+	}
+	return size
+}
+
+// KeyMidpoint returns the smallest item in the RedBlackTree greater than or
+// equal to the midpoint of the key range, computed by calling 'mid' with the
+// minimum and maximum items, or the maximum item if the midpoint is greater
+// than every item. Unlike Median, which balances the number of items on either
+// side, KeyMidpoint balances the range of keys. If the tree is empty, nil is
+// returned.
+//
+// O(log(n))
+func (t *RedBlackTree) KeyMidpoint(mid func(a, b Item) Item) Item {
+	min, max := t.minNode(), t.maxNode()
+	if min == nil {
+		return nil
+	}
+	if n := t.root.findGreaterOrEqual(mid(min.item, max.item)); n != nil {
+		return n.item
+	}
+	return max.item
+}
+
+// MinBy returns the item in the RedBlackTree for which 'metric' returns the
+// smallest value. Ties are resolved in favour of the smallest item. If the
+// tree is empty, nil is returned.
+//
+// O(n) where n is the total number of items in the tree.
+func (t *RedBlackTree) MinBy(metric func(Item) float64) Item {
+	return t.extremeBy(metric, func(a, b float64) bool { return a < b })
+}
+
+// MaxBy returns the item in the RedBlackTree for which 'metric' returns the
+// largest value. Ties are resolved in favour of the smallest item. If the tree
+// is empty, nil is returned.
+//
+// O(n) where n is the total number of items in the tree.
+func (t *RedBlackTree) MaxBy(metric func(Item) float64) Item {
+	return t.extremeBy(metric, func(a, b float64) bool { return a > b })
+}
+
+// extremeBy returns the first item in ascending order whose metric is better
+// than that of every preceding item.
+func (t *RedBlackTree) extremeBy(metric func(Item) float64, better func(a, b float64) bool) Item {
+	var best Item
+	var bestValue float64
+	for n := t.minNode(); n != nil; n = n.next() {
+		if v := metric(n.item); best == nil || better(v, bestValue) {
+			best, bestValue = n.item, v
+		}
+	}
+	return best
+}
+
+// Jaccard returns the Jaccard similarity of the RedBlackTree and 'other': the
+// number of items in their intersection divided by the number of items in
+// their union. Two empty trees are considered identical, with a similarity of
+// 1.
+//
+// O(n + m) where n and m are the number of items in each tree.
+func (t *RedBlackTree) Jaccard(other *RedBlackTree) float64 {
+	var intersection int
+	an, bn := t.minNode(), other.minNode()
+	for an != nil && bn != nil {
+		switch {
+		case an.item.Less(bn.item):
+			an = an.next()
+		case bn.item.Less(an.item):
+			bn = bn.next()
+		default:
+			intersection++
+			an, bn = an.next(), bn.next()
+		}
+	}
+	union := t.size + other.size - intersection
+	if union == 0 {
+		return 1
+	}
+	return float64(intersection) / float64(union)
+}
+
+// Median returns the lower median item in the RedBlackTree, which is the item
+// at zero-based rank Size()/2. If the tree is empty, nil is returned.
+//
+// Without subtree sizes stored in each node, the median cannot be selected in
+// O(log(n)); instead, Median walks half of the items from the maximum item.
+//
+// O(n/2) where n is the total number of items in the tree.
+func (t *RedBlackTree) Median() Item {
+	n := t.nodeAtRank(t.size / 2)
+	if n == nil {
+		return nil
+	}
+	return n.item
+}
+
+// Min returns the minimum item in the RedBlackTree. If the tree is
+// empty, nil is returned.
+//
+// O(log(n))
+func (t *RedBlackTree) Min() Item {
+	n := t.minNode()
+	if n == nil {
+		return nil
+	}
+	return n.item
+}
+
+func (t *RedBlackTree) minNode() *node {
+	if t.root == nil {
+		return nil
+	}
+	n := t.root.min()
+	if n.dead {
+		n = n.next()
+	}
+	return n
+}
+
+// Max returns the maximum item in the RedBlackTree. If the tree is
+// empty, nil is returned.
+//
+// O(log(n))
+func (t *RedBlackTree) Max() Item {
+	n := t.maxNode()
+	if n == nil {
+		return nil
+	}
+	return n.item
+}
+
+func (t *RedBlackTree) maxNode() *node {
+	if t.root == nil {
+		return nil
+	}
+	n := t.root.max()
+	if n.dead {
+		n = n.prev()
+	}
+	return n
+}
+
+// nodeAtRank returns the node at the provided zero-based rank, walking from
+// whichever end of the tree is closer. If the rank is out of range, nil is
+// returned.
+//
+// Nodes do not store the sizes of their subtrees, as doing so would add to the
+// size of every node and to the cost of every rotation, so a rank can't be
+// selected by descending from the root.
+func (t *RedBlackTree) nodeAtRank(rank int) *node {
+	if rank < 0 || rank >= t.size {
+		return nil
+	}
+	if rank < t.size/2 {
+		n := t.minNode()
+		for ; rank > 0; rank-- {
+			n = n.next()
+		}
+		return n
+	}
+	n := t.maxNode()
+	for rank = t.size - 1 - rank; rank > 0; rank-- {
+		n = n.prev()
+	}
+	return n
+}
+
+// Size returns the number of items in the RedBlackTree.
+//
+// O(1)
+func (t *RedBlackTree) Size() int {
+	return t.size
+}
+
+// Reversed returns a read-only view of the RedBlackTree in which the ordering
+// of items is inverted. No items are copied; the view reads directly from the
+// tree, and so reflects any later changes made to it.
+func (t *RedBlackTree) Reversed() ReverseView {
+	return ReverseView{t: t}
+}
+
+// ReverseView is a read-only view of a RedBlackTree with the ordering of items
+// inverted, such that Ascend visits items from largest to smallest.
+type ReverseView struct {
+	t *RedBlackTree
+}
+
+// Ascend starts at the last Item of the underlying tree and calls 'fn' for
+// each Item until no Items remain or fn returns 'false'.
+//
+// O(log(n) + m) where n is the total number of items in the tree and m is the
+// number of items ranged over.
+func (v ReverseView) Ascend(fn func(Item) bool) {
+	v.t.Descend(fn)
+}
+
+// Descend starts at the first Item of the underlying tree and calls 'fn' for
+// each Item until no Items remain or fn returns 'false'.
+//
+// O(log(n) + m) where n is the total number of items in the tree and m is the
+// number of items ranged over.
+func (v ReverseView) Descend(fn func(Item) bool) {
+	v.t.Ascend(fn)
+}
+
+// Range calls 'fn' for each Item in the range [lo, hi) of the inverted
+// ordering, i.e. each Item less than or equal to 'lo' and greater than 'hi' in
+// the underlying tree, until no Items remain in the range or fn returns
+// 'false'. Items are visited in the view's ascending order, or in its
+// descending order if 'desc' is 'true'.
+//
+// O(log(n) + m) where n is the total number of items in the tree and m is the
+// number of items ranged over.
+func (v ReverseView) Range(lo, hi Item, desc bool, fn func(Item) bool) {
+	if desc {
+		n := v.t.root.findGreater(hi)
+		for n != nil && !lo.Less(n.item) && fn(n.item) {
+			n = n.next()
+		}
+		return
+	}
+	n, _ := v.t.root.bracket(lo)
+	for n != nil && hi.Less(n.item) && fn(n.item) {
+		n = n.prev()
+	}
+}
+
+// Get retrieves an item in the underlying tree equal to the provided item. If
+// an item was found, it is returned. Otherwise, nil is returned.
+//
+// O(log(n))
+func (v ReverseView) Get(item Item) Item {
+	return v.t.Get(item)
+}
+
+// Min returns the minimum item in the view, which is the maximum item in the
+// underlying tree. If the tree is empty, nil is returned.
+//
+// O(log(n))
+func (v ReverseView) Min() Item {
+	return v.t.Max()
+}
+
+// Max returns the maximum item in the view, which is the minimum item in the
+// underlying tree. If the tree is empty, nil is returned.
+//
+// O(log(n))
+func (v ReverseView) Max() Item {
+	return v.t.Min()
+}
+
+// Size returns the number of items in the underlying tree.
+//
+// O(1)
+func (v ReverseView) Size() int {
+	return v.t.Size()
+}
+
+// Operation is a single change to a RedBlackTree: an upsert of Item or, if
+// Delete is 'true', a deletion of the item equal to Item.
+type Operation struct {
+	Item   Item
+	Delete bool
+}
+
+// WithPreview returns a read-only view of the RedBlackTree as it would be if
+// the provided operation had been applied, without modifying the tree. An
+// upsert is previewed according to the tree's upsert behaviour, such as
+// combining equal items for a tree created with NewAggregating. An upsert that
+// would fail, such as one outside of the range of a tree created with
+// NewBounded, is previewed as having no effect.
+//
+// The view shares the structure of the tree, overlaying the single change as
+// it is read, and so reflects any later changes made to the tree. The
+// operation is resolved against the tree each time the view is read. Reading
+// the view does not count as an access to the tree's items, such as for
+// HotKeys.
+//
+// O(1)
+func (t *RedBlackTree) WithPreview(op Operation) PreviewView {
+	return PreviewView{t: t, op: op}
+}
+
+// PreviewView is a read-only view of a RedBlackTree with a single pending
+// operation applied.
+type PreviewView struct {
+	t  *RedBlackTree
+	op Operation
+}
+
+// resolve returns the item in the tree equal to the operation's item, or nil
+// if there is none, along with the item that takes its place in the view, or
+// nil if the view has no such item.
+func (v PreviewView) resolve() (old, item Item) {
+	t, op := v.t, v.op
+	if n := t.root.find(op.Item); n != nil {
+		old = n.item
+	}
+	switch {
+	case op.Delete:
+		return old, nil
+	case t.lo != nil && (op.Item.Less(t.lo) || !op.Item.Less(t.hi)):
+		return old, old
+	case old == nil:
+		return old, op.Item
+	case t.insertOnce:
+		return old, old
+	case t.combine != nil:
+		return old, t.combine(old, op.Item)
+	default:
+		return old, op.Item
+	}
+}
+
+// Ascend starts at the first Item in the view and calls 'fn' for each Item
+// until no Items remain or fn returns 'false'.
+//
+// O(log(n) + m) where n is the total number of items in the tree and m is the
+// number of items ranged over.
+func (v PreviewView) Ascend(fn func(Item) bool) {
+	key := v.op.Item
+	_, replacement := v.resolve()
+	pending := true
+	for n := v.t.minNode(); n != nil; {
+		item := n.item
+		switch {
+		case !pending || item.Less(key):
+			n = n.next()
+		case key.Less(item):
+			pending = false
+			if replacement == nil {
+				continue
+			}
+			item = replacement
+		default:
+			pending = false
+			n = n.next()
+			if replacement == nil {
+				continue
+			}
+			item = replacement
+		}
+		if !fn(item) {
+			return
+		}
+	}
+	if pending && replacement != nil {
+		fn(replacement)
 	}
 }
 
-// Delete deletes an item in the RedBlackTree equal to the provided
-// item. If an item was deleted, it is returned. Otherwise, nil is returned.
-//
-// Note: equality for items a & b is: (!a.Less(b) && !b.Less(a)).
+// Get retrieves an item in the view equal to the provided item. If an item was
+// found, it is returned. Otherwise, nil is returned.
 //
 // O(log(n))
-func (t *RedBlackTree) Delete(item Item) Item {
-	if t.root == nil {
-		return nil
+func (v PreviewView) Get(item Item) Item {
+	if equal(item, v.op.Item) {
+		_, replacement := v.resolve()
+		return replacement
 	}
-	return t.root.deleteItem(t, item)
+	if n := v.t.root.find(item); n != nil {
+		return n.item
+	}
+	return nil
 }
 
-// DeleteMax deletes the maximum item in the RedBlackTree, returning
-// it. If the tree is empty, nil is returned.
+// Size returns the number of items in the view.
 //
 // O(log(n))
-func (t *RedBlackTree) DeleteMax() Item {
-	if t.root == nil {
-		return nil
+func (v PreviewView) Size() int {
+	old, replacement := v.resolve()
+	switch {
+	case old == nil && replacement != nil:
+		return v.t.size + 1
+	case old != nil && replacement == nil:
+		return v.t.size - 1
 	}
-	return t.root.deleteMax(t)
+	return v.t.size
 }
 
-// DeleteMin deletes the minimum item in the RedBlackTree, returning
-// it. If the tree is empty, nil is returned.
+// CheckDuplicates returns the groups of items in the batch that are equal to
+// one another, and so would collide if upserted into a RedBlackTree. Each group
+// contains at least two items, in their order within the batch, and the groups
+// are returned in ascending order. The provided slice is not modified.
 //
-// O(log(n))
-func (t *RedBlackTree) DeleteMin() Item {
-	if t.root == nil {
-		return nil
+// Note: equality for items a & b is: (!a.Less(b) && !b.Less(a)).
+//
+// O(n*log(n)) where n is the number of items.
+func CheckDuplicates(items []Item) [][]Item {
+	sorted := make(itemSlice, len(items))
+	copy(sorted, items)
+	sort.Stable(sorted)
+
+	var groups [][]Item
+	for i := 0; i < len(sorted); {
+		j := i + 1
+		for j < len(sorted) && !sorted[i].Less(sorted[j]) {
+			j++
+		}
+		if j-i > 1 {
+			groups = append(groups, sorted[i:j:j])
+		}
+		i = j
 	}
-	return t.root.deleteMin(t)
+	return groups
 }
 
-// Get retrieves an item in the RedBlackTree equal to the provided
-// item. If an item was found, it is returned. Otherwise, nil is returned.
+// itemSlice sorts items in ascending order.
+type itemSlice []Item
+
+func (s itemSlice) Len() int           { return len(s) }
+func (s itemSlice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s itemSlice) Less(i, j int) bool { return s[i].Less(s[j]) }
+
+// DiffRebalance applies each sequence of operations to a new, empty
+// RedBlackTree and returns 'true' if the resulting trees differ in structure:
+// the arrangement of their nodes, the colour of each node, or the item it
+// holds. Trees with equal items may still differ in structure if the
+// operations were applied in a different order.
 //
-// Note: equality for items a & b is: (!a.Less(b) && !b.Less(a)).
+// DiffRebalance is intended for testing code built on a RedBlackTree.
 //
-// O(log(n))
-func (t *RedBlackTree) Get(item Item) Item {
-	n := t.root.find(item)
-	if n == nil {
-		return nil
+// O((n + m)*log(n + m)) where n and m are the number of operations in each
+// sequence.
+func DiffRebalance(ops1, ops2 []Operation) bool {
+	var a, b RedBlackTree
+	a.apply(ops1)
+	b.apply(ops2)
+	return !sameShape(a.root, b.root)
+}
+
+// apply applies each of the operations to the RedBlackTree in order.
+func (t *RedBlackTree) apply(ops []Operation) {
+	for _, op := range ops {
+		if op.Delete {
+			t.Delete(op.Item)
+		} else {
+			t.Upsert(op.Item)
+		}
 	}
-	return n.item
 }
 
-// Upsert inserts (or replaces) an item into the RedBlackTree. If an
-// item was replaced, it is returned. Otherwise, nil is returned.
-//
-// Note: equality for items a & b is: (!a.Less(b) && !b.Less(a)).
+// sameShape returns 'true' if the subtrees rooted at the provided nodes have
+// the same structure, colours and items.
+func sameShape(a, b *node) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.colour == b.colour && equal(a.item, b.item) &&
+		sameShape(a.left, b.left) && sameShape(a.right, b.right)
+}
+
+// FlatNode is a node of a RedBlackTree encoded in a flat array by
+// FlattenToArray. Left and Right are the indices of the node's children in the
+// array, or -1 if the node has no such child. Dead is 'true' if the node is a
+// tombstone in a tree created with NewLazyDelete.
+type FlatNode struct {
+	Item        Item
+	Left, Right int
+	Black       bool
+	Dead        bool
+}
+
+// FlattenToArray returns the structure of the RedBlackTree encoded as a flat
+// array of nodes in pre-order, such that the root is at index zero. The
+// array can be traversed without pointer chasing, and the tree can be
+// reconstructed using BuildFromArray.
 //
-// O(log(n))
-func (t *RedBlackTree) Upsert(item Item) Item {
+// O(n) where n is the total number of items in the tree.
+func (t *RedBlackTree) FlattenToArray() []FlatNode {
 	if t.root == nil {
-		t.root = newNode(nil, item)
-		t.root.colour = colourBlack
-		t.size++
 		return nil
 	}
-	n, oldItem := t.root.insert(item)
-	if oldItem == nil {
-		t.size++
-		n.rebalanceInsert(t)
+	return flattenNode(t.root, make([]FlatNode, 0, t.size+t.tombstones))
+}
+
+func flattenNode(n *node, nodes []FlatNode) []FlatNode {
+	i := len(nodes)
+	nodes = append(nodes, FlatNode{Item: n.item, Left: -1, Right: -1, Black: n.isBlack(), Dead: n.dead})
+	if n.left != nil {
+		nodes[i].Left = len(nodes)
+		nodes = flattenNode(n.left, nodes)
 	}
-	return oldItem
+	if n.right != nil {
+		nodes[i].Right = len(nodes)
+		nodes = flattenNode(n.right, nodes)
+	}
+	return nodes
 }
 
-// Exists returns 'true' if an item equal to the provided item
-// exists in the RedBlackTree.
+// BuildFromArray returns a new RedBlackTree with the structure encoded in the
+// provided array, which must have been produced by FlattenToArray. If any of
+// the nodes are tombstones, the tree is returned in lazy-delete mode, as if
+// created with NewLazyDelete, with the tombstones in place.
 //
-// Note: equality for items a & b is: (!a.Less(b) && !b.Less(a)).
+// O(n) where n is the total number of items in the array.
+func BuildFromArray(flat []FlatNode) *RedBlackTree {
+	var t RedBlackTree
+	if len(flat) == 0 {
+		return &t
+	}
+	nodes := make([]node, len(flat))
+	for i, f := range flat {
+		n := &nodes[i]
+		n.item = f.Item
+		if f.Black {
+			n.colour = colourBlack
+		}
+		if f.Dead {
+			n.dead = true
+			t.tombstones++
+		}
+		if f.Left >= 0 {
+			n.left = &nodes[f.Left]
+			n.left.parent = n
+		}
+		if f.Right >= 0 {
+			n.right = &nodes[f.Right]
+			n.right.parent = n
+		}
+	}
+	t.root = &nodes[0]
+	t.size = len(nodes) - t.tombstones
+	t.lazy = t.tombstones > 0
+	return &t
+}
+
+// SymmetricDifference returns a new RedBlackTree containing the items that are
+// present in exactly one of the provided trees.
 //
-// O(log(n))
-func (t *RedBlackTree) Exists(item Item) bool {
-	return t.Get(item) != nil
+// O(n + m) where n and m are the number of items in each tree.
+func SymmetricDifference(a, b *RedBlackTree) *RedBlackTree {
+	var items []Item
+	an, bn := a.minNode(), b.minNode()
+	for an != nil && bn != nil {
+		switch {
+		case an.item.Less(bn.item):
+			items = append(items, an.item)
+			an = an.next()
+		case bn.item.Less(an.item):
+			items = append(items, bn.item)
+			bn = bn.next()
+		default:
+			an, bn = an.next(), bn.next()
+		}
+	}
+	for ; an != nil; an = an.next() {
+		items = append(items, an.item)
+	}
+	for ; bn != nil; bn = bn.next() {
+		items = append(items, bn.item)
+	}
+	return buildTree(items)
 }
 
-// Min returns the minimum item in the RedBlackTree. If the tree is
-// empty, nil is returned.
+// MergeTopK returns the 'k' largest distinct items across all of the provided
+// trees, in descending order. Items that are equal across trees are returned
+// only once.
 //
-// O(log(n))
-func (t *RedBlackTree) Min() Item {
-	n := t.minNode()
-	if n == nil {
-		return nil
+// O((k+d)*log(m)) where m is the number of trees and d is the number of
+// duplicate items skipped.
+func MergeTopK(k int, trees ...*RedBlackTree) []Item {
+	h := &cursorHeap{desc: true}
+	for _, t := range trees {
+		if n := t.maxNode(); n != nil {
+			h.nodes = append(h.nodes, n)
+		}
 	}
-	return n.item
+	heap.Init(h)
+
+	var items []Item
+	for len(items) < k && h.Len() > 0 {
+		n := h.nodes[0]
+		if l := len(items); l == 0 || n.item.Less(items[l-1]) {
+			items = append(items, n.item)
+		}
+		if n = n.prev(); n != nil {
+			h.nodes[0] = n
+			heap.Fix(h, 0)
+		} else {
+			heap.Pop(h)
+		}
+	}
+	return items
 }
 
-func (t *RedBlackTree) minNode() *node {
-	if t.root == nil {
-		return nil
+// cursorHeap is a heap of nodes from multiple trees, ordered by item. The
+// smallest item is at the top of the heap, or the largest if 'desc' is 'true'.
+type cursorHeap struct {
+	nodes []*node
+	desc  bool
+}
+
+func (h *cursorHeap) Len() int      { return len(h.nodes) }
+func (h *cursorHeap) Swap(i, j int) { h.nodes[i], h.nodes[j] = h.nodes[j], h.nodes[i] }
+func (h *cursorHeap) Less(i, j int) bool {
+	if h.desc {
+		return h.nodes[j].item.Less(h.nodes[i].item)
 	}
-	return t.root.min()
+	return h.nodes[i].item.Less(h.nodes[j].item)
+}
+func (h *cursorHeap) Push(x interface{}) { h.nodes = append(h.nodes, x.(*node)) }
+func (h *cursorHeap) Pop() interface{} {
+	n := h.nodes[len(h.nodes)-1]
+	h.nodes = h.nodes[:len(h.nodes)-1]
+	return n
 }
 
-// Max returns the maximum item in the RedBlackTree. If the tree is
-// empty, nil is returned.
-//
-// O(log(n))
-func (t *RedBlackTree) Max() Item {
-	n := t.maxNode()
-	if n == nil {
-		return nil
+// rangeBound is an endpoint of a range passed to CountRanges.
+type rangeBound struct {
+	item  Item
+	index int
+	hi    bool
+}
+
+// rangeBounds sorts range endpoints in ascending order.
+type rangeBounds []rangeBound
+
+func (r rangeBounds) Len() int           { return len(r) }
+func (r rangeBounds) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+func (r rangeBounds) Less(i, j int) bool { return r[i].item.Less(r[j].item) }
+
+// itemGap is a pair of adjacent items and the gap between them, along with
+// the pair's position in the tree.
+type itemGap struct {
+	pair [2]Item
+	gap  float64
+	pos  int
+}
+
+// gapHeap is a heap of item gaps with the narrowest gap at the top of the
+// heap. Of equal gaps, the latest pair is at the top.
+type gapHeap []itemGap
+
+func (h gapHeap) Len() int            { return len(h) }
+func (h gapHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h gapHeap) Less(i, j int) bool  { return h.less(h[i], h[j]) }
+func (h *gapHeap) Push(x interface{}) { *h = append(*h, x.(itemGap)) }
+func (h *gapHeap) Pop() interface{} {
+	g := (*h)[len(*h)-1]
+	*h = (*h)[:len(*h)-1]
+	return g
+}
+
+func (h gapHeap) less(a, b itemGap) bool {
+	if a.gap != b.gap {
+		return a.gap < b.gap
 	}
-	return n.item
+	return a.pos > b.pos
 }
 
-func (t *RedBlackTree) maxNode() *node {
-	if t.root == nil {
-		return nil
+// hotNode is a node along with its access count.
+type hotNode struct {
+	n        *node
+	accesses *uint64
+}
+
+// hotNodes sorts nodes by descending access count.
+type hotNodes []hotNode
+
+func (h hotNodes) Len() int      { return len(h) }
+func (h hotNodes) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h hotNodes) Less(i, j int) bool {
+	return atomic.LoadUint64(h[i].accesses) > atomic.LoadUint64(h[j].accesses)
+}
+
+// compare returns the three-way comparison of 'a' and 'b', using 'c' (which
+// must be 'a' as a Comparer) if it is non-nil.
+func compare(c Comparer, a, b Item) int {
+	if c != nil {
+		return c.Compare(b)
+	}
+	if a.Less(b) {
+		return -1
+	}
+	if b.Less(a) {
+		return 1
 	}
-	return t.root.max()
+	return 0
 }
 
-// Size returns the number of items in the RedBlackTree.
-//
-// O(1)
-func (t *RedBlackTree) Size() int {
-	return t.size
+func equal(a, b Item) bool {
+	return !a.Less(b) && !b.Less(a)
+}
+
+// rebuild replaces the contents of the RedBlackTree with the provided nodes,
+// which must be in ascending order, arranged as a balanced tree.
+func (t *RedBlackTree) rebuild(nodes []*node) {
+	// All nodes are black except those on the deepest level, which keeps
+	// the black height equal along every path.
+	var redDepth int
+	for size := len(nodes); size > 1; size >>= 1 {
+		redDepth++
+	}
+	t.root = buildNodes(nodes, nil, 0, redDepth)
+	t.size = len(nodes)
+	t.bumpVersion()
+	// Any tombstoned nodes are no longer part of the tree.
+	t.tombstones = 0
+	if t.finger != nil && t.finger.dead {
+		t.finger = nil
+	}
+}
+
+// bumpVersion records a write to the RedBlackTree for VersionedAscend.
+func (t *RedBlackTree) bumpVersion() {
+	t.version++
+}
+
+// buildTree returns a new, balanced RedBlackTree containing the provided
+// items, which must be in ascending order with no duplicates.
+func buildTree(items []Item) *RedBlackTree {
+	var t RedBlackTree
+	nodes := make([]*node, len(items))
+	for i, item := range items {
+		nodes[i] = t.newNode(nil, item)
+	}
+	t.rebuild(nodes)
+	return &t
+}
+
+func buildNodes(nodes []*node, parent *node, depth, redDepth int) *node {
+	if len(nodes) == 0 {
+		return nil
+	}
+	mid := len(nodes) / 2
+	n := nodes[mid]
+	n.parent = parent
+	n.colour = colourBlack
+	if depth > 0 && depth == redDepth {
+		n.colour = colourRed
+	}
+	n.left = buildNodes(nodes[:mid], n, depth+1, redDepth)
+	n.right = buildNodes(nodes[mid+1:], n, depth+1, redDepth)
+	return n
 }
 
 type colour uint8
@@ -241,6 +2890,7 @@ const (
 
 type node struct {
 	colour      colour
+	dead        bool
 	parent      *node
 	left, right *node
 	item        Item
@@ -255,12 +2905,15 @@ func newNode(parent *node, item Item) *node {
 }
 
 func (n *node) find(item Item) *node {
+	c, _ := item.(Comparer)
 	for n != nil {
-		switch {
-		case item.Less(n.item):
+		switch cmp := compare(c, item, n.item); {
+		case cmp < 0:
 			n = n.left
-		case n.item.Less(item):
+		case cmp > 0:
 			n = n.right
+		case n.dead:
+			return nil
 		default:
 			return n
 		}
@@ -269,46 +2922,135 @@ func (n *node) find(item Item) *node {
 }
 
 func (n *node) findGreaterOrEqual(item Item) *node {
-	if n == nil {
-		return nil
-	}
-	for {
+	var greater *node
+	for n != nil {
 		switch {
 		case item.Less(n.item):
-			if n.left == nil {
-				return n
-			}
+			greater = n
 			n = n.left
 		case n.item.Less(item):
-			if n.right == nil {
-				return nil
-			}
 			n = n.right
+		case n.dead:
+			return n.next()
 		default:
 			return n
 		}
 	}
+	if greater != nil && greater.dead {
+		return greater.next()
+	}
+	return greater
+}
+
+// bracket returns the nodes with the largest item less than or equal to, and
+// the smallest item greater than or equal to, the provided item.
+func (n *node) bracket(item Item) (lower, upper *node) {
+	for n != nil {
+		switch {
+		case item.Less(n.item):
+			upper = n
+			n = n.left
+		case n.item.Less(item):
+			lower = n
+			n = n.right
+		case n.dead:
+			return n.prev(), n.next()
+		default:
+			return n, n
+		}
+	}
+	if lower != nil && lower.dead {
+		lower = lower.prev()
+	}
+	if upper != nil && upper.dead {
+		upper = upper.next()
+	}
+	return lower, upper
+}
+
+func (n *node) findGreater(item Item) *node {
+	var greater *node
+	for n != nil {
+		if item.Less(n.item) {
+			greater = n
+			n = n.left
+		} else {
+			n = n.right
+		}
+	}
+	if greater != nil && greater.dead {
+		return greater.next()
+	}
+	return greater
+}
+
+func (n *node) findLess(item Item) *node {
+	var less *node
+	for n != nil {
+		if n.item.Less(item) {
+			less = n
+			n = n.right
+		} else {
+			n = n.left
+		}
+	}
+	if less != nil && less.dead {
+		return less.prev()
+	}
+	return less
 }
 
-func (n *node) deleteMax(t *RedBlackTree) Item {
-	return n.max().deleteNode(t)
+// depth returns the number of ancestors of the node.
+func (n *node) depth() int {
+	var depth int
+	for n = n.parent; n != nil; n = n.parent {
+		depth++
+	}
+	return depth
+}
+
+func (n *node) height() int {
+	if n == nil {
+		return 0
+	}
+	l, r := n.left.height(), n.right.height()
+	if l > r {
+		return l + 1
+	}
+	return r + 1
 }
 
-func (n *node) deleteMin(t *RedBlackTree) Item {
-	return n.min().deleteNode(t)
+func (n *node) nodesAtDepth(depth int, nodes []*node) []*node {
+	if n == nil {
+		return nodes
+	}
+	if depth == 0 {
+		return append(nodes, n)
+	}
+	nodes = n.left.nodesAtDepth(depth-1, nodes)
+	return n.right.nodesAtDepth(depth-1, nodes)
 }
 
-func (n *node) deleteItem(t *RedBlackTree, item Item) Item {
+func (n *node) deleteItem(t *RedBlackTree, item Item) (Item, bool) {
 	n = n.find(item)
 	if n == nil {
-		return nil
+		return nil, false
 	}
-	return n.deleteNode(t)
+	return n.deleteNode(t), true
 }
 
 func (n *node) deleteNode(t *RedBlackTree) Item {
+	t.bumpVersion()
 	t.size--
 	delItem := n.item
+	if t.lazy {
+		n.dead = true
+		t.tombstones++
+		if t.onDelete != nil {
+			t.onDelete(delItem)
+		}
+		return delItem
+	}
 
 	var child, parent *node
 	for {
@@ -327,20 +3069,37 @@ func (n *node) deleteNode(t *RedBlackTree) Item {
 		// replace minimum value in right subtree with node to delete.
 		min := n.right.min()
 		n.item = min.item
+		t.moveState(min, n)
 		n = min
 	}
 
-	if n.isRed() {
-		return delItem
-	}
-	if child.isRed() {
+	switch {
+	case n.isRed():
+	case child.isRed():
 		child.colour = colourBlack
-		return delItem
+	default:
+		child.rebalanceDelete(t, parent)
+	}
+	t.freeNode(n)
+	if t.onDelete != nil {
+		t.onDelete(delItem)
 	}
-	child.rebalanceDelete(t, parent)
 	return delItem
 }
 
+// deleteAndNext deletes the node, returning its item and the node holding the
+// next item in the tree.
+func (n *node) deleteAndNext(t *RedBlackTree) (*node, Item) {
+	if !t.lazy && n.left != nil && n.right != nil {
+		// The node's item is replaced by its successor's, which is
+		// removed from the tree in its place.
+		item := n.deleteNode(t)
+		return n, item
+	}
+	next := n.next()
+	return next, n.deleteNode(t)
+}
+
 func (n *node) rebalanceDelete(t *RedBlackTree, parent *node) {
 	var s *node
 	for {
@@ -456,7 +3215,27 @@ func (n *node) max() *node {
 	return n
 }
 
+// next returns the node holding the next item in the tree, skipping any
+// tombstoned nodes.
 func (n *node) next() *node {
+	n = n.successor()
+	for n != nil && n.dead {
+		n = n.successor()
+	}
+	return n
+}
+
+// prev returns the node holding the previous item in the tree, skipping any
+// tombstoned nodes.
+func (n *node) prev() *node {
+	n = n.predecessor()
+	for n != nil && n.dead {
+		n = n.predecessor()
+	}
+	return n
+}
+
+func (n *node) successor() *node {
 	if n.right != nil {
 		return n.right.min()
 	}
@@ -468,7 +3247,7 @@ func (n *node) next() *node {
 	return parent
 }
 
-func (n *node) prev() *node {
+func (n *node) predecessor() *node {
 	if n.left != nil {
 		return n.left.max()
 	}
@@ -480,40 +3259,69 @@ func (n *node) prev() *node {
 	return parent
 }
 
-func (n *node) insert(item Item) (*node, Item) {
+// climb returns the lowest of the node and its ancestors whose subtree must
+// contain the position of the provided item.
+func (n *node) climb(item Item) *node {
+	c, _ := item.(Comparer)
+	cmp := compare(c, item, n.item)
+	for cmp != 0 {
+		// Find the nearest ancestor bounding the node's subtree on the
+		// side of the item.
+		a := n
+		for a.parent != nil && (a == a.parent.left) == (cmp < 0) {
+			a = a.parent
+		}
+		if a.parent == nil {
+			return n
+		}
+		switch bound := compare(c, item, a.parent.item); {
+		case bound == 0:
+			return a.parent
+		case bound != cmp:
+			return n
+		}
+		n = a.parent
+	}
+	return n
+}
+
+// insert adds a new node for the provided item, returning it and 'true'. If
+// a node with an equal item already exists, it is returned with 'false'.
+func (n *node) insert(t *RedBlackTree, item Item) (*node, bool) {
+	c, _ := item.(Comparer)
 	for {
-		switch {
-		case item.Less(n.item):
+		switch cmp := compare(c, item, n.item); {
+		case cmp < 0:
 			if n.left == nil {
-				n.left = newNode(n, item)
-				return n.left, nil
+				n.left = t.newNode(n, item)
+				return n.left, true
 			}
 			n = n.left
-		case n.item.Less(item):
+		case cmp > 0:
 			if n.right == nil {
-				n.right = newNode(n, item)
-				return n.right, nil
+				n.right = t.newNode(n, item)
+				return n.right, true
 			}
 			n = n.right
 		default:
-			oldItem := n.item
-			n.item = item
-			return n, oldItem
+			return n, false
 		}
 	}
 }
 
-func (n *node) rebalanceInsert(t *RedBlackTree) {
+// rebalanceInsert restores the red-black properties after inserting the node,
+// returning the number of rotations performed.
+func (n *node) rebalanceInsert(t *RedBlackTree) int {
 	var g *node
 	for {
 		// Case 1.
 		if n.parent == nil {
 			n.colour = colourBlack
-			return
+			return 0
 		}
 		// Case 2.
 		if n.parent.colour == colourBlack {
-			return
+			return 0
 		}
 		// Case 3.
 		g = n.grandparent()
@@ -534,14 +3342,17 @@ func (n *node) rebalanceInsert(t *RedBlackTree) {
 		n = g
 	}
 	// Case 4.
+	rotations := 1
 	if n == n.parent.right && n.parent == g.left {
 		n.parent.rotateLeft(t)
 		n = n.left
 		g = n.grandparent()
+		rotations++
 	} else if n == n.parent.left && n.parent == g.right {
 		n.parent.rotateRight(t)
 		n = n.right
 		g = n.grandparent()
+		rotations++
 	}
 	// Case 5.
 	n.parent.colour = colourBlack
@@ -551,6 +3362,7 @@ func (n *node) rebalanceInsert(t *RedBlackTree) {
 	} else {
 		g.rotateLeft(t)
 	}
+	return rotations
 }
 
 func (n *node) rotateLeft(t *RedBlackTree) {
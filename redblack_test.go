@@ -1,6 +1,10 @@
 package tree_test
 
 import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
 	"testing"
 
 	"github.com/ryanfowler/tree"
@@ -195,6 +199,22 @@ func TestAscendGreaterOrEqual(t *testing.T) {
 		t.Fatal("Unexpected ascend function called")
 		return true
 	})
+
+	// Items between stored keys start at the next greater item.
+	var sparse tree.RedBlackTree
+	for i := 0; i < 100; i += 10 {
+		sparse.Upsert(tree.Int(i))
+	}
+	for i := 0; i < 90; i++ {
+		var first tree.Item
+		sparse.AscendGreaterOrEqual(tree.Int(i), func(item tree.Item) bool {
+			first = item
+			return false
+		})
+		if expected := tree.Int((i + 9) / 10 * 10); first != expected {
+			t.Fatalf("Unexpected first item for %d: %v - %v", i, first, expected)
+		}
+	}
 }
 
 func TestAscendLess(t *testing.T) {
@@ -246,3 +266,3409 @@ func TestAscendRange(t *testing.T) {
 		t.Fatalf("Unexpected range end: %d", i)
 	}
 }
+
+func TestAscendPages(t *testing.T) {
+	const size = 100
+	const pageSize = 7
+
+	var rb tree.RedBlackTree
+	rb.AscendPages(pageSize, func(page []tree.Item) bool {
+		t.Fatal("Unexpected page for empty tree")
+		return true
+	})
+
+	for i := 0; i < size; i++ {
+		rb.Upsert(tree.Int(i))
+	}
+
+	var i, pages int
+	rb.AscendPages(pageSize, func(page []tree.Item) bool {
+		pages++
+		if len(page) != pageSize && i+len(page) != size {
+			t.Fatalf("Unexpected page length: %d", len(page))
+		}
+		for _, item := range page {
+			if int(item.(tree.Int)) != i {
+				t.Fatalf("Unexpected page value: %v - %d", item, i)
+			}
+			i++
+		}
+		return true
+	})
+	if i != size {
+		t.Fatalf("Unexpected number of items paged: %d", i)
+	}
+	if pages != size/pageSize+1 {
+		t.Fatalf("Unexpected number of pages: %d", pages)
+	}
+
+	pages = 0
+	rb.AscendPages(pageSize, func(page []tree.Item) bool {
+		pages++
+		return pages < 3
+	})
+	if pages != 3 {
+		t.Fatalf("Unexpected number of pages after stopping: %d", pages)
+	}
+}
+
+func TestGetWithPosition(t *testing.T) {
+	var rb tree.RedBlackTree
+	if it, isMin, isMax := rb.GetWithPosition(tree.Int(1)); it != nil || isMin || isMax {
+		t.Fatalf("Unexpected result on empty tree: %v %t %t", it, isMin, isMax)
+	}
+
+	rb.Upsert(tree.Int(1))
+	if it, isMin, isMax := rb.GetWithPosition(tree.Int(1)); it != tree.Int(1) || !isMin || !isMax {
+		t.Fatalf("Unexpected result for single item: %v %t %t", it, isMin, isMax)
+	}
+
+	for i := 0; i < 100; i++ {
+		rb.Upsert(tree.Int(i))
+	}
+
+	tests := []struct {
+		item         tree.Int
+		isMin, isMax bool
+	}{
+		{0, true, false},
+		{99, false, true},
+		{50, false, false},
+	}
+	for _, test := range tests {
+		it, isMin, isMax := rb.GetWithPosition(test.item)
+		if it != test.item || isMin != test.isMin || isMax != test.isMax {
+			t.Fatalf("Unexpected result for %v: %v %t %t", test.item, it, isMin, isMax)
+		}
+	}
+
+	if it, isMin, isMax := rb.GetWithPosition(tree.Int(200)); it != nil || isMin || isMax {
+		t.Fatalf("Unexpected result for missing item: %v %t %t", it, isMin, isMax)
+	}
+}
+
+func TestRange(t *testing.T) {
+	var rb tree.RedBlackTree
+	rb.Range(tree.Int(5), tree.Int(20), false, nil)
+	rb.Range(tree.Int(5), tree.Int(20), true, nil)
+	for i := 0; i < 25; i++ {
+		rb.Upsert(tree.Int(i))
+	}
+
+	i := 5
+	rb.Range(tree.Int(5), tree.Int(20), false, func(item tree.Item) bool {
+		if int(item.(tree.Int)) != i {
+			t.Fatalf("Unexpected range value: %v", item)
+		}
+		i++
+		return true
+	})
+	if i != 20 {
+		t.Fatalf("Unexpected range end: %d", i)
+	}
+
+	i = 19
+	rb.Range(tree.Int(5), tree.Int(20), true, func(item tree.Item) bool {
+		if int(item.(tree.Int)) != i {
+			t.Fatalf("Unexpected range value: %v", item)
+		}
+		i--
+		return true
+	})
+	if i != 4 {
+		t.Fatalf("Unexpected range end: %d", i)
+	}
+
+	i = 24
+	rb.Range(tree.Int(-5), tree.Int(50), true, func(item tree.Item) bool {
+		if int(item.(tree.Int)) != i {
+			t.Fatalf("Unexpected range value: %v", item)
+		}
+		i--
+		return i >= 10
+	})
+	if i != 9 {
+		t.Fatalf("Unexpected range end: %d", i)
+	}
+
+	rb.Range(tree.Int(30), tree.Int(50), true, func(item tree.Item) bool {
+		t.Fatalf("Unexpected range value: %v", item)
+		return true
+	})
+}
+
+func TestCountPrefixes(t *testing.T) {
+	var rb tree.RedBlackTree
+	if counts := rb.CountPrefixes(2); len(counts) != 0 {
+		t.Fatalf("Unexpected counts for empty tree: %v", counts)
+	}
+
+	for _, s := range []string{"a", "apple", "apply", "apricot", "banana", "band", "b", "cherry"} {
+		rb.Upsert(tree.String(s))
+	}
+
+	expected := map[string]int{"a": 1, "ap": 3, "b": 1, "ba": 2, "ch": 1}
+	counts := rb.CountPrefixes(2)
+	if len(counts) != len(expected) {
+		t.Fatalf("Unexpected prefix counts: %v", counts)
+	}
+	for prefix, count := range expected {
+		if counts[prefix] != count {
+			t.Fatalf("Unexpected count for prefix %q: %d", prefix, counts[prefix])
+		}
+	}
+
+	for _, prefixLen := range []int{0, -1} {
+		if counts := rb.CountPrefixes(prefixLen); len(counts) != 1 || counts[""] != rb.Size() {
+			t.Fatalf("Unexpected counts for prefix length %d: %v", prefixLen, counts)
+		}
+	}
+}
+
+func TestItemAtFraction(t *testing.T) {
+	const size = 1001
+
+	var rb tree.RedBlackTree
+	if it := rb.ItemAtFraction(0.5); it != nil {
+		t.Fatalf("Unexpected item from empty tree: %v", it)
+	}
+
+	for i := 0; i < size; i++ {
+		rb.Upsert(tree.Int(i))
+	}
+
+	if it := rb.ItemAtFraction(0); it != rb.Min() {
+		t.Fatalf("Unexpected item at fraction 0: %v", it)
+	}
+	if it := rb.ItemAtFraction(1); it != rb.Max() {
+		t.Fatalf("Unexpected item at fraction 1: %v", it)
+	}
+	if it := rb.ItemAtFraction(-1); it != rb.Min() {
+		t.Fatalf("Unexpected item at fraction -1: %v", it)
+	}
+	if it := rb.ItemAtFraction(2); it != rb.Max() {
+		t.Fatalf("Unexpected item at fraction 2: %v", it)
+	}
+
+	for i := 0; i < 10; i++ {
+		it := rb.ItemAtFraction(float64(i) / 9)
+		expected := i * (size - 1) / 9
+		if int(it.(tree.Int)) != expected {
+			t.Fatalf("Unexpected representative %d: %v - %d", i, it, expected)
+		}
+	}
+}
+
+type counter struct {
+	key   int
+	count int
+}
+
+func (c *counter) Less(than tree.Item) bool {
+	return c.key < than.(*counter).key
+}
+
+func TestNewAggregating(t *testing.T) {
+	rb := tree.NewAggregating(func(old, new tree.Item) tree.Item {
+		return &counter{
+			key:   old.(*counter).key,
+			count: old.(*counter).count + new.(*counter).count,
+		}
+	})
+
+	for i := 0; i < 1000; i++ {
+		rb.Upsert(&counter{key: i % 10, count: 1})
+	}
+
+	if rb.Size() != 10 {
+		t.Fatalf("Unexpected size: %d", rb.Size())
+	}
+	rb.Ascend(func(item tree.Item) bool {
+		if c := item.(*counter); c.count != 100 {
+			t.Fatalf("Unexpected count for key %d: %d", c.key, c.count)
+		}
+		return true
+	})
+
+	old := rb.Upsert(&counter{key: 5, count: 5})
+	if old == nil || old.(*counter).count != 100 {
+		t.Fatalf("Unexpected item returned from upsert: %+v", old)
+	}
+	if c := rb.Get(&counter{key: 5}).(*counter); c.count != 105 {
+		t.Fatalf("Unexpected count after upsert: %d", c.count)
+	}
+}
+
+func TestPopNearest(t *testing.T) {
+	dist := func(a, b tree.Item) float64 {
+		d := float64(a.(tree.Int) - b.(tree.Int))
+		if d < 0 {
+			return -d
+		}
+		return d
+	}
+
+	var rb tree.RedBlackTree
+	if it := rb.PopNearest(tree.Int(5), dist); it != nil {
+		t.Fatalf("Unexpected item from empty tree: %v", it)
+	}
+
+	for _, i := range []int{0, 10, 14, 20, 31, 50} {
+		rb.Upsert(tree.Int(i))
+	}
+
+	// Query 15 repeatedly, ties favour the smaller item.
+	expected := []int{14, 10, 20, 0, 31, 50}
+	for _, exp := range expected {
+		it := rb.PopNearest(tree.Int(15), dist)
+		if it == nil || int(it.(tree.Int)) != exp {
+			t.Fatalf("Unexpected nearest item: %v - %d", it, exp)
+		}
+		if rb.Exists(it) {
+			t.Fatalf("Unexpected item still exists: %v", it)
+		}
+	}
+	if rb.Size() != 0 {
+		t.Fatalf("Unexpected size: %d", rb.Size())
+	}
+
+	rb.Upsert(tree.Int(15))
+	if it := rb.PopNearest(tree.Int(15), dist); it != tree.Int(15) {
+		t.Fatalf("Unexpected exact nearest item: %v", it)
+	}
+}
+
+func TestNewInsertOnce(t *testing.T) {
+	rb := tree.NewInsertOnce()
+
+	first := &counter{key: 1, count: 1}
+	if it := rb.Upsert(first); it != nil {
+		t.Fatalf("Unexpected item from first upsert: %+v", it)
+	}
+	for i := 2; i <= 10; i++ {
+		it := rb.Upsert(&counter{key: 1, count: i})
+		if it != first {
+			t.Fatalf("Unexpected item from repeated upsert: %+v", it)
+		}
+	}
+
+	if rb.Size() != 1 {
+		t.Fatalf("Unexpected size: %d", rb.Size())
+	}
+	if it := rb.Get(&counter{key: 1}); it != first {
+		t.Fatalf("Unexpected stored item: %+v", it)
+	}
+}
+
+func TestRanges(t *testing.T) {
+	next := func(item tree.Item) tree.Item {
+		return item.(tree.Int) + 1
+	}
+
+	var rb tree.RedBlackTree
+	if ranges := rb.Ranges(next); len(ranges) != 0 {
+		t.Fatalf("Unexpected ranges for empty tree: %v", ranges)
+	}
+
+	for _, i := range []int{1, 2, 3, 7, 8, 10} {
+		rb.Upsert(tree.Int(i))
+	}
+
+	expected := [][2]tree.Item{
+		{tree.Int(1), tree.Int(3)},
+		{tree.Int(7), tree.Int(8)},
+		{tree.Int(10), tree.Int(10)},
+	}
+	ranges := rb.Ranges(next)
+	if len(ranges) != len(expected) {
+		t.Fatalf("Unexpected ranges: %v", ranges)
+	}
+	for i := range expected {
+		if ranges[i] != expected[i] {
+			t.Fatalf("Unexpected range %d: %v", i, ranges[i])
+		}
+	}
+}
+
+func TestRetainIf(t *testing.T) {
+	const size = 1000
+
+	isPrime := func(item tree.Item) bool {
+		n := int(item.(tree.Int))
+		if n < 2 {
+			return false
+		}
+		for i := 2; i*i <= n; i++ {
+			if n%i == 0 {
+				return false
+			}
+		}
+		return true
+	}
+
+	var retained, deleted tree.RedBlackTree
+	for i := 0; i < size; i++ {
+		retained.Upsert(tree.Int(i))
+		deleted.Upsert(tree.Int(i))
+	}
+
+	if removed := retained.RetainIf(func(tree.Item) bool { return true }); removed != 0 {
+		t.Fatalf("Unexpected number of items removed: %d", removed)
+	}
+
+	removed := retained.RetainIf(isPrime)
+	for i := 0; i < size; i++ {
+		if !isPrime(tree.Int(i)) {
+			deleted.Delete(tree.Int(i))
+		}
+	}
+
+	if err := tree.Verify(&retained); err != nil {
+		t.Fatalf("Invalid tree after RetainIf: %v", err)
+	}
+	if removed != size-deleted.Size() {
+		t.Fatalf("Unexpected number of items removed: %d", removed)
+	}
+	if retained.Size() != deleted.Size() {
+		t.Fatalf("Unexpected size: %d - %d", retained.Size(), deleted.Size())
+	}
+	var items []tree.Item
+	deleted.Ascend(func(item tree.Item) bool {
+		items = append(items, item)
+		return true
+	})
+	var i int
+	retained.Ascend(func(item tree.Item) bool {
+		if item != items[i] {
+			t.Fatalf("Unexpected item: %v - %v", item, items[i])
+		}
+		i++
+		return true
+	})
+
+	for j := 0; j < size; j++ {
+		retained.Upsert(tree.Int(j))
+	}
+	if err := tree.Verify(&retained); err != nil {
+		t.Fatalf("Invalid tree after re-inserting: %v", err)
+	}
+
+	if removed := retained.RetainIf(func(tree.Item) bool { return false }); removed != size {
+		t.Fatalf("Unexpected number of items removed: %d", removed)
+	}
+	if retained.Size() != 0 || retained.Min() != nil {
+		t.Fatalf("Unexpected non-empty tree: %d", retained.Size())
+	}
+}
+
+func TestAscendEqual(t *testing.T) {
+	var rb tree.RedBlackTree
+	rb.AscendEqual(tree.Int(5), nil)
+	for i := 0; i < 25; i += 2 {
+		rb.Upsert(tree.Int(i))
+	}
+
+	var visited []tree.Item
+	rb.AscendEqual(tree.Int(10), func(item tree.Item) bool {
+		visited = append(visited, item)
+		return true
+	})
+	if len(visited) != 1 || visited[0] != tree.Int(10) {
+		t.Fatalf("Unexpected items visited: %v", visited)
+	}
+
+	rb.AscendEqual(tree.Int(11), func(item tree.Item) bool {
+		t.Fatalf("Unexpected item visited: %v", item)
+		return true
+	})
+	rb.AscendEqual(tree.Int(50), func(item tree.Item) bool {
+		t.Fatalf("Unexpected item visited: %v", item)
+		return true
+	})
+}
+
+func TestReversed(t *testing.T) {
+	var rb tree.RedBlackTree
+	for i := 0; i < 100; i++ {
+		rb.Upsert(tree.Int(i))
+	}
+	rev := rb.Reversed()
+
+	var descended []tree.Item
+	rb.Descend(func(item tree.Item) bool {
+		descended = append(descended, item)
+		return true
+	})
+	var i int
+	rev.Ascend(func(item tree.Item) bool {
+		if item != descended[i] {
+			t.Fatalf("Unexpected reversed value: %v - %v", item, descended[i])
+		}
+		i++
+		return true
+	})
+	if i != len(descended) {
+		t.Fatalf("Unexpected number of reversed items: %d", i)
+	}
+
+	if rev.Min() != tree.Int(99) || rev.Max() != tree.Int(0) {
+		t.Fatalf("Unexpected reversed min/max: %v, %v", rev.Min(), rev.Max())
+	}
+	if rev.Get(tree.Int(42)) != tree.Int(42) || rev.Size() != 100 {
+		t.Fatalf("Unexpected reversed get/size: %v, %d", rev.Get(tree.Int(42)), rev.Size())
+	}
+
+	i = 20
+	rev.Range(tree.Int(20), tree.Int(5), false, func(item tree.Item) bool {
+		if int(item.(tree.Int)) != i {
+			t.Fatalf("Unexpected reversed range value: %v - %d", item, i)
+		}
+		i--
+		return true
+	})
+	if i != 5 {
+		t.Fatalf("Unexpected reversed range end: %d", i)
+	}
+
+	i = 6
+	rev.Range(tree.Int(20), tree.Int(5), true, func(item tree.Item) bool {
+		if int(item.(tree.Int)) != i {
+			t.Fatalf("Unexpected reversed range value: %v - %d", item, i)
+		}
+		i++
+		return true
+	})
+	if i != 21 {
+		t.Fatalf("Unexpected reversed range end: %d", i)
+	}
+}
+
+func TestHotKeys(t *testing.T) {
+	rb := tree.NewTracking()
+	for i := 0; i < 100; i++ {
+		rb.Upsert(tree.Int(i))
+	}
+	if hot := rb.HotKeys(3); len(hot) != 0 {
+		t.Fatalf("Unexpected hot keys before access: %v", hot)
+	}
+
+	for i := 0; i < 100; i++ {
+		rb.Get(tree.Int(i))
+		if i%10 == 0 {
+			rb.Exists(tree.Int(50))
+		}
+		if i%20 == 0 {
+			rb.Get(tree.Int(7))
+			rb.Get(tree.Int(7))
+		}
+		if i%25 == 0 {
+			rb.Exists(tree.Int(93))
+		}
+	}
+
+	// 7: 11 accesses, 50: 11 accesses, 93: 5 accesses.
+	expected := []tree.Item{tree.Int(7), tree.Int(50), tree.Int(93)}
+	hot := rb.HotKeys(3)
+	if len(hot) != len(expected) {
+		t.Fatalf("Unexpected hot keys: %v", hot)
+	}
+	for i := range expected {
+		if hot[i] != expected[i] {
+			t.Fatalf("Unexpected hot key %d: %v", i, hot[i])
+		}
+	}
+
+	rb.ResetAccessCounts()
+	rb.Get(tree.Int(3))
+	if hot := rb.HotKeys(3); len(hot) != 1 || hot[0] != tree.Int(3) {
+		t.Fatalf("Unexpected hot keys after reset: %v", hot)
+	}
+
+	var untracked tree.RedBlackTree
+	untracked.Upsert(tree.Int(1))
+	untracked.Get(tree.Int(1))
+	if hot := untracked.HotKeys(1); len(hot) != 0 {
+		t.Fatalf("Unexpected hot keys for untracked tree: %v", hot)
+	}
+}
+
+func TestFirstOrderingViolation(t *testing.T) {
+	var rb tree.RedBlackTree
+	if _, _, ok := rb.FirstOrderingViolation(); ok {
+		t.Fatal("Unexpected violation in empty tree")
+	}
+
+	counters := make([]*counter, 20)
+	for i := range counters {
+		counters[i] = &counter{key: i}
+		rb.Upsert(counters[i])
+	}
+	if a, b, ok := rb.FirstOrderingViolation(); ok {
+		t.Fatalf("Unexpected violation: %+v, %+v", a, b)
+	}
+
+	// Mutate a key after insertion.
+	counters[10].key = 15
+	a, b, ok := rb.FirstOrderingViolation()
+	if !ok {
+		t.Fatal("Expected ordering violation")
+	}
+	if a != counters[10] || b != counters[11] {
+		t.Fatalf("Unexpected violation: %+v, %+v", a, b)
+	}
+}
+
+func TestMergeTopK(t *testing.T) {
+	if items := tree.MergeTopK(5); len(items) != 0 {
+		t.Fatalf("Unexpected items with no trees: %v", items)
+	}
+
+	var a, b, c, empty tree.RedBlackTree
+	all := make(map[int]bool)
+	for i := 0; i < 300; i++ {
+		switch {
+		case i%3 == 0:
+			a.Upsert(tree.Int(i))
+		case i%7 == 0:
+			b.Upsert(tree.Int(i))
+		case i%5 == 0:
+			c.Upsert(tree.Int(i))
+		default:
+			continue
+		}
+		all[i] = true
+	}
+	// Add some overlapping items.
+	for i := 0; i < 300; i += 30 {
+		b.Upsert(tree.Int(i))
+		c.Upsert(tree.Int(i))
+	}
+
+	for _, k := range []int{0, 1, 10, 50, 1000} {
+		var expected []int
+		for i := 299; i >= 0 && len(expected) < k; i-- {
+			if all[i] {
+				expected = append(expected, i)
+			}
+		}
+		items := tree.MergeTopK(k, &a, &empty, &b, &c)
+		if len(items) != len(expected) {
+			t.Fatalf("Unexpected number of items for k=%d: %d", k, len(items))
+		}
+		for i := range expected {
+			if int(items[i].(tree.Int)) != expected[i] {
+				t.Fatalf("Unexpected item %d for k=%d: %v - %d", i, k, items[i], expected[i])
+			}
+		}
+	}
+}
+
+func TestNewBounded(t *testing.T) {
+	rb := tree.NewBounded(tree.Int(10), tree.Int(20))
+
+	for i := 10; i < 20; i++ {
+		if _, err := rb.TryUpsert(tree.Int(i)); err != nil {
+			t.Fatalf("Unexpected error for in-range item %d: %v", i, err)
+		}
+	}
+	for _, i := range []int{-5, 9, 20, 100} {
+		if _, err := rb.TryUpsert(tree.Int(i)); err != tree.ErrOutOfRange {
+			t.Fatalf("Unexpected error for out-of-range item %d: %v", i, err)
+		}
+	}
+	if rb.Size() != 10 || rb.Min() != tree.Int(10) || rb.Max() != tree.Int(19) {
+		t.Fatalf("Unexpected tree contents: %d, %v, %v", rb.Size(), rb.Min(), rb.Max())
+	}
+	if it := rb.Get(tree.Int(25)); it != nil {
+		t.Fatalf("Unexpected item: %v", it)
+	}
+
+	func() {
+		defer func() {
+			if r := recover(); r != tree.ErrOutOfRange {
+				t.Fatalf("Unexpected panic value: %v", r)
+			}
+		}()
+		rb.Upsert(tree.Int(20))
+	}()
+}
+
+func TestAscendWithGapRank(t *testing.T) {
+	gap := func(a, b tree.Item) int {
+		return int(b.(tree.Int) - a.(tree.Int))
+	}
+
+	var rb tree.RedBlackTree
+	rb.AscendWithGapRank(gap, nil)
+
+	values := []int{1, 2, 5, 6, 10, 20}
+	for _, v := range values {
+		rb.Upsert(tree.Int(v))
+	}
+
+	expected := []int{1, 3, 1, 4, 10, 0}
+	var i int
+	rb.AscendWithGapRank(gap, func(item tree.Item, rank, gapToNext int) bool {
+		if int(item.(tree.Int)) != values[i] || rank != i || gapToNext != expected[i] {
+			t.Fatalf("Unexpected values at %d: %v, %d, %d", i, item, rank, gapToNext)
+		}
+		i++
+		return true
+	})
+	if i != len(values) {
+		t.Fatalf("Unexpected number of items visited: %d", i)
+	}
+
+	i = 0
+	rb.AscendWithGapRank(gap, func(item tree.Item, rank, gapToNext int) bool {
+		i++
+		return rank < 2
+	})
+	if i != 3 {
+		t.Fatalf("Unexpected number of items visited after stopping: %d", i)
+	}
+}
+
+func TestSingleInRange(t *testing.T) {
+	var rb tree.RedBlackTree
+	if it, ok := rb.SingleInRange(tree.Int(0), tree.Int(10)); ok || it != nil {
+		t.Fatalf("Unexpected item in empty tree: %v", it)
+	}
+
+	for _, i := range []int{5, 10, 11, 20} {
+		rb.Upsert(tree.Int(i))
+	}
+
+	tests := []struct {
+		lo, hi tree.Int
+		item   tree.Item
+		ok     bool
+	}{
+		{12, 20, nil, false},
+		{21, 30, nil, false},
+		{0, 10, tree.Int(5), true},
+		{11, 25, nil, false},
+		{15, 21, tree.Int(20), true},
+		{10, 11, tree.Int(10), true},
+		{5, 12, nil, false},
+	}
+	for _, test := range tests {
+		it, ok := rb.SingleInRange(test.lo, test.hi)
+		if it != test.item || ok != test.ok {
+			t.Fatalf("Unexpected result for [%v, %v): %v, %t", test.lo, test.hi, it, ok)
+		}
+	}
+}
+
+func TestLevelOrder(t *testing.T) {
+	var rb tree.RedBlackTree
+	rb.LevelOrder(nil)
+
+	// Inserting 1-6 in order results in the tree:
+	//       2
+	//     /   \
+	//    1     4
+	//         / \
+	//        3   5
+	//             \
+	//              6
+	for i := 1; i <= 6; i++ {
+		rb.Upsert(tree.Int(i))
+	}
+
+	expected := []struct {
+		item  tree.Item
+		level int
+	}{
+		{tree.Int(2), 0},
+		{tree.Int(1), 1},
+		{tree.Int(4), 1},
+		{tree.Int(3), 2},
+		{tree.Int(5), 2},
+		{tree.Int(6), 3},
+	}
+	var i int
+	rb.LevelOrder(func(item tree.Item, level int) bool {
+		if item != expected[i].item || level != expected[i].level {
+			t.Fatalf("Unexpected item at %d: %v, %d", i, item, level)
+		}
+		i++
+		return true
+	})
+	if i != len(expected) {
+		t.Fatalf("Unexpected number of items visited: %d", i)
+	}
+
+	i = 0
+	rb.LevelOrder(func(item tree.Item, level int) bool {
+		i++
+		return level < 1
+	})
+	if i != 2 {
+		t.Fatalf("Unexpected number of items visited after stopping: %d", i)
+	}
+}
+
+func TestGetByKey(t *testing.T) {
+	compare := func(key interface{}, item tree.Item) int {
+		return key.(int) - item.(*counter).key
+	}
+
+	var rb tree.RedBlackTree
+	if it := rb.GetByKey(5, compare); it != nil {
+		t.Fatalf("Unexpected item in empty tree: %v", it)
+	}
+
+	for i := 0; i < 100; i += 2 {
+		rb.Upsert(&counter{key: i, count: i * 10})
+	}
+
+	for i := 0; i < 100; i++ {
+		it := rb.GetByKey(i, compare)
+		if i%2 == 1 {
+			if it != nil {
+				t.Fatalf("Unexpected item for key %d: %+v", i, it)
+			}
+			continue
+		}
+		if it == nil || it.(*counter).key != i || it.(*counter).count != i*10 {
+			t.Fatalf("Unexpected item for key %d: %+v", i, it)
+		}
+	}
+}
+
+func TestOnDelete(t *testing.T) {
+	var rb tree.RedBlackTree
+	deleted := make(map[tree.Item]int)
+	rb.OnDelete(func(item tree.Item) {
+		deleted[item]++
+	})
+
+	for i := 0; i < 100; i++ {
+		rb.Upsert(tree.Int(i))
+	}
+
+	rb.Delete(tree.Int(50))
+	rb.Delete(tree.Int(500))
+	rb.DeleteMin()
+	rb.DeleteMax()
+	rb.PopNearest(tree.Int(50), func(a, b tree.Item) float64 {
+		return float64(a.(tree.Int) - b.(tree.Int))
+	})
+	rb.RetainIf(func(item tree.Item) bool {
+		return item.(tree.Int)%2 == 0
+	})
+	rb.RetainIf(func(item tree.Item) bool {
+		return true
+	})
+	for rb.Size() > 0 {
+		rb.DeleteMin()
+	}
+
+	if len(deleted) != 100 {
+		t.Fatalf("Unexpected number of deleted items: %d", len(deleted))
+	}
+	for item, count := range deleted {
+		if count != 1 {
+			t.Fatalf("Unexpected hook count for %v: %d", item, count)
+		}
+	}
+
+	rb.OnDelete(nil)
+	rb.Upsert(tree.Int(1))
+	rb.Delete(tree.Int(1))
+	if deleted[tree.Int(1)] != 1 {
+		t.Fatalf("Unexpected hook call after removal: %d", deleted[tree.Int(1)])
+	}
+}
+
+func TestOnInsert(t *testing.T) {
+	type call struct {
+		item, replaced tree.Item
+	}
+
+	var calls []call
+	hook := func(item, replaced tree.Item) {
+		calls = append(calls, call{item, replaced})
+	}
+
+	var rb tree.RedBlackTree
+	rb.OnInsert(hook)
+
+	c1 := &counter{key: 1}
+	c2 := &counter{key: 2}
+	c3 := &counter{key: 1, count: 1}
+	rb.Upsert(c1)
+	rb.Upsert(c2)
+	rb.Upsert(c3)
+
+	expected := []call{{c1, nil}, {c2, nil}, {c3, c1}}
+	if len(calls) != len(expected) {
+		t.Fatalf("Unexpected number of hook calls: %d", len(calls))
+	}
+	for i := range expected {
+		if calls[i] != expected[i] {
+			t.Fatalf("Unexpected hook call %d: %+v", i, calls[i])
+		}
+	}
+
+	calls = nil
+	once := tree.NewInsertOnce()
+	once.OnInsert(hook)
+	once.Upsert(c1)
+	once.Upsert(c3)
+	if len(calls) != 1 || calls[0] != (call{c1, nil}) {
+		t.Fatalf("Unexpected hook calls for insert-once tree: %+v", calls)
+	}
+
+	calls = nil
+	rb.OnInsert(nil)
+	rb.Upsert(c1)
+	if len(calls) != 0 {
+		t.Fatalf("Unexpected hook calls after removal: %+v", calls)
+	}
+}
+
+func TestFlattenToArray(t *testing.T) {
+	var rb tree.RedBlackTree
+	if flat := rb.FlattenToArray(); len(flat) != 0 {
+		t.Fatalf("Unexpected flat nodes for empty tree: %v", flat)
+	}
+	if built := tree.BuildFromArray(nil); built.Size() != 0 {
+		t.Fatalf("Unexpected size for empty built tree: %d", built.Size())
+	}
+
+	for i := 0; i < 1000; i++ {
+		rb.Upsert(tree.Int((i * 7919) % 1000))
+	}
+
+	flat := rb.FlattenToArray()
+	if len(flat) != rb.Size() {
+		t.Fatalf("Unexpected number of flat nodes: %d", len(flat))
+	}
+	var level0 tree.Item
+	rb.LevelOrder(func(item tree.Item, level int) bool {
+		level0 = item
+		return false
+	})
+	if flat[0].Item != level0 {
+		t.Fatalf("Unexpected root item: %v - %v", flat[0].Item, level0)
+	}
+
+	built := tree.BuildFromArray(flat)
+	if err := tree.Verify(built); err != nil {
+		t.Fatalf("Invalid built tree: %v", err)
+	}
+	if built.Size() != rb.Size() {
+		t.Fatalf("Unexpected built size: %d", built.Size())
+	}
+	var items []tree.Item
+	rb.Ascend(func(item tree.Item) bool {
+		items = append(items, item)
+		return true
+	})
+	var i int
+	built.Ascend(func(item tree.Item) bool {
+		if item != items[i] {
+			t.Fatalf("Unexpected built item: %v - %v", item, items[i])
+		}
+		i++
+		return true
+	})
+
+	// Both trees should remain usable independently.
+	built.Upsert(tree.Int(5000))
+	built.Delete(tree.Int(0))
+	if err := tree.Verify(built); err != nil {
+		t.Fatalf("Invalid built tree after modification: %v", err)
+	}
+	if rb.Exists(tree.Int(5000)) || !rb.Exists(tree.Int(0)) {
+		t.Fatal("Unexpected modification of original tree")
+	}
+}
+
+func TestSymmetricDifference(t *testing.T) {
+	var a, b tree.RedBlackTree
+	if diff := tree.SymmetricDifference(&a, &b); diff.Size() != 0 {
+		t.Fatalf("Unexpected size for empty trees: %d", diff.Size())
+	}
+
+	counts := make(map[int]int)
+	for i := 0; i < 500; i += 3 {
+		a.Upsert(tree.Int(i))
+		counts[i]++
+	}
+	for i := 0; i < 700; i += 5 {
+		b.Upsert(tree.Int(i))
+		counts[i]++
+	}
+
+	diff := tree.SymmetricDifference(&a, &b)
+	if err := tree.Verify(diff); err != nil {
+		t.Fatalf("Invalid symmetric difference tree: %v", err)
+	}
+	var expected int
+	for i, count := range counts {
+		if count != 1 {
+			if diff.Exists(tree.Int(i)) {
+				t.Fatalf("Unexpected item in symmetric difference: %d", i)
+			}
+			continue
+		}
+		expected++
+		if !diff.Exists(tree.Int(i)) {
+			t.Fatalf("Missing item in symmetric difference: %d", i)
+		}
+	}
+	if diff.Size() != expected {
+		t.Fatalf("Unexpected size: %d - %d", diff.Size(), expected)
+	}
+}
+
+func TestPresenceBitmap(t *testing.T) {
+	var rb tree.RedBlackTree
+	if bitmap := rb.PresenceBitmap(10, 5); bitmap != nil {
+		t.Fatalf("Unexpected bitmap for empty range: %v", bitmap)
+	}
+
+	for i := 0; i < 1000; i += 7 {
+		rb.Upsert(tree.Int(i))
+	}
+
+	const lo, hi = 90, 310
+	bitmap := rb.PresenceBitmap(lo, hi)
+	if len(bitmap) != hi-lo+1 {
+		t.Fatalf("Unexpected bitmap length: %d", len(bitmap))
+	}
+	for i, present := range bitmap {
+		if exists := rb.Exists(tree.Int(lo + i)); present != exists {
+			t.Fatalf("Unexpected presence for %d: %t", lo+i, present)
+		}
+	}
+
+	bitmap = rb.PresenceBitmap(1001, 1010)
+	for i, present := range bitmap {
+		if present {
+			t.Fatalf("Unexpected presence beyond max: %d", 1001+i)
+		}
+	}
+}
+
+func TestAscendLeaves(t *testing.T) {
+	var rb tree.RedBlackTree
+	rb.AscendLeaves(nil)
+
+	for i := 0; i < 1000; i++ {
+		rb.Upsert(tree.Int((i * 7919) % 1000))
+	}
+	for i := 0; i < 1000; i += 3 {
+		rb.Delete(tree.Int(i))
+	}
+
+	var leaves int
+	var prev tree.Item
+	height := -1
+	rb.AscendLeaves(func(item tree.Item, blackHeight int) bool {
+		if prev != nil && !prev.Less(item) {
+			t.Fatalf("Unexpected leaf order: %v, %v", prev, item)
+		}
+		if height >= 0 && blackHeight != height {
+			t.Fatalf("Unexpected black height for %v: %d - %d", item, blackHeight, height)
+		}
+		if blackHeight <= 0 {
+			t.Fatalf("Unexpected black height for %v: %d", item, blackHeight)
+		}
+		prev = item
+		height = blackHeight
+		leaves++
+		return true
+	})
+	if leaves == 0 {
+		t.Fatal("Unexpected tree with no leaves")
+	}
+
+	leaves = 0
+	rb.AscendLeaves(func(item tree.Item, blackHeight int) bool {
+		leaves++
+		return false
+	})
+	if leaves != 1 {
+		t.Fatalf("Unexpected number of leaves visited after stopping: %d", leaves)
+	}
+}
+
+// expensive is an Item that counts the number of comparisons made.
+type expensive struct {
+	key   int
+	calls *int
+}
+
+func (e expensive) Less(than tree.Item) bool {
+	*e.calls++
+	return e.key < than.(expensive).key
+}
+
+// comparingExpensive is an expensive Item that also implements Comparer.
+type comparingExpensive struct {
+	expensive
+}
+
+func (e comparingExpensive) Less(than tree.Item) bool {
+	return e.expensive.Less(than.(comparingExpensive).expensive)
+}
+
+func (e comparingExpensive) Compare(than tree.Item) int {
+	*e.calls++
+	return e.key - than.(comparingExpensive).key
+}
+
+func TestComparer(t *testing.T) {
+	var calls int
+	item := func(i int) tree.Item {
+		return comparingExpensive{expensive{key: i, calls: &calls}}
+	}
+
+	var rb tree.RedBlackTree
+	for i := 0; i < 1000; i++ {
+		rb.Upsert(item((i * 7919) % 1000))
+	}
+	for i := 0; i < 1000; i += 2 {
+		if it := rb.Delete(item(i)); it == nil {
+			t.Fatalf("Unexpected missing item: %d", i)
+		}
+	}
+	if err := tree.Verify(&rb); err != nil {
+		t.Fatalf("Invalid tree: %v", err)
+	}
+	for i := 0; i < 1000; i++ {
+		if exists := rb.Exists(item(i)); exists != (i%2 == 1) {
+			t.Fatalf("Unexpected existence for %d: %t", i, exists)
+		}
+	}
+	if old := rb.Upsert(item(1)); old == nil {
+		t.Fatal("Expected replaced item")
+	}
+}
+
+func benchmarkGet(b *testing.B, item func(key int, calls *int) tree.Item) {
+	const size = 1 << 16
+
+	var calls int
+	var rb tree.RedBlackTree
+	for i := 0; i < size; i++ {
+		rb.Upsert(item(i, &calls))
+	}
+
+	calls = 0
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rb.Get(item(i%size, &calls))
+	}
+	b.ReportMetric(float64(calls)/float64(b.N), "comparisons/op")
+}
+
+func BenchmarkGetLess(b *testing.B) {
+	benchmarkGet(b, func(key int, calls *int) tree.Item {
+		return expensive{key: key, calls: calls}
+	})
+}
+
+func BenchmarkGetCompare(b *testing.B) {
+	benchmarkGet(b, func(key int, calls *int) tree.Item {
+		return comparingExpensive{expensive{key: key, calls: calls}}
+	})
+}
+
+func TestWindowByRank(t *testing.T) {
+	var rb tree.RedBlackTree
+	if items := rb.WindowByRank(0, 5); len(items) != 0 {
+		t.Fatalf("Unexpected window for empty tree: %v", items)
+	}
+
+	for i := 0; i < 100; i++ {
+		rb.Upsert(tree.Int(i * 2))
+	}
+
+	tests := []struct {
+		center, radius int
+		first, length  int
+	}{
+		{50, 10, 80, 21},
+		{3, 10, 0, 14},
+		{95, 10, 170, 15},
+		{0, 0, 0, 1},
+		{-20, 5, 0, 0},
+		{120, 5, 0, 0},
+	}
+	for _, test := range tests {
+		items := rb.WindowByRank(test.center, test.radius)
+		if len(items) != test.length {
+			t.Fatalf("Unexpected window length for %d±%d: %d", test.center, test.radius, len(items))
+		}
+		for i, item := range items {
+			if int(item.(tree.Int)) != test.first+i*2 {
+				t.Fatalf("Unexpected window item for %d±%d: %v", test.center, test.radius, item)
+			}
+		}
+	}
+}
+
+func TestAscendMutable(t *testing.T) {
+	const size = 1000
+
+	var rb tree.RedBlackTree
+	rb.AscendMutable(nil)
+	for i := 0; i < size; i++ {
+		rb.Upsert(tree.Int(i))
+	}
+
+	var i int
+	rb.AscendMutable(func(c *tree.MutCursor) bool {
+		if int(c.Item().(tree.Int)) != i {
+			t.Fatalf("Unexpected cursor item: %v - %d", c.Item(), i)
+		}
+		if i%3 != 0 {
+			if it := c.Delete(); it != c.Item() {
+				t.Fatalf("Unexpected deleted item: %v", it)
+			}
+			if it := c.Delete(); it != nil {
+				t.Fatalf("Unexpected second deleted item: %v", it)
+			}
+		}
+		i++
+		return true
+	})
+	if i != size {
+		t.Fatalf("Unexpected number of items visited: %d", i)
+	}
+	if err := tree.Verify(&rb); err != nil {
+		t.Fatalf("Invalid tree: %v", err)
+	}
+	if rb.Size() != (size+2)/3 {
+		t.Fatalf("Unexpected size: %d", rb.Size())
+	}
+	rb.Ascend(func(item tree.Item) bool {
+		if item.(tree.Int)%3 != 0 {
+			t.Fatalf("Unexpected remaining item: %v", item)
+		}
+		return true
+	})
+
+	i = 0
+	rb.AscendMutable(func(c *tree.MutCursor) bool {
+		c.Delete()
+		i++
+		return i < 10
+	})
+	if rb.Size() != (size+2)/3-10 || rb.Min() != tree.Int(30) {
+		t.Fatalf("Unexpected tree after stopping: %d, %v", rb.Size(), rb.Min())
+	}
+	if err := tree.Verify(&rb); err != nil {
+		t.Fatalf("Invalid tree: %v", err)
+	}
+}
+
+func TestCountRanges(t *testing.T) {
+	var rb tree.RedBlackTree
+	if counts := rb.CountRanges([][2]tree.Item{{tree.Int(0), tree.Int(10)}}); len(counts) != 1 || counts[0] != 0 {
+		t.Fatalf("Unexpected counts for empty tree: %v", counts)
+	}
+
+	for i := 0; i < 1000; i += 3 {
+		rb.Upsert(tree.Int(i))
+	}
+
+	rng := rand.New(rand.NewSource(42))
+	ranges := make([][2]tree.Item, 200)
+	for i := range ranges {
+		ranges[i] = [2]tree.Item{tree.Int(rng.Intn(1200) - 100), tree.Int(rng.Intn(1200) - 100)}
+	}
+
+	counts := rb.CountRanges(ranges)
+	if len(counts) != len(ranges) {
+		t.Fatalf("Unexpected number of counts: %d", len(counts))
+	}
+	for i, r := range ranges {
+		var expected int
+		rb.AscendRange(r[0], r[1], func(tree.Item) bool {
+			expected++
+			return true
+		})
+		if counts[i] != expected {
+			t.Fatalf("Unexpected count for range [%v, %v): %d - %d", r[0], r[1], counts[i], expected)
+		}
+	}
+}
+
+func TestWidestGaps(t *testing.T) {
+	gap := func(a, b tree.Item) float64 {
+		return float64(b.(tree.Int) - a.(tree.Int))
+	}
+
+	var rb tree.RedBlackTree
+	if pairs := rb.WidestGaps(3, gap); len(pairs) != 0 {
+		t.Fatalf("Unexpected gaps for empty tree: %v", pairs)
+	}
+
+	for _, i := range []int{0, 1, 2, 10, 11, 12, 40, 41, 60, 61, 62, 70, 71} {
+		rb.Upsert(tree.Int(i))
+	}
+
+	expected := [][2]tree.Item{
+		{tree.Int(12), tree.Int(40)},
+		{tree.Int(41), tree.Int(60)},
+		{tree.Int(2), tree.Int(10)},
+		{tree.Int(62), tree.Int(70)},
+	}
+	pairs := rb.WidestGaps(4, gap)
+	if len(pairs) != len(expected) {
+		t.Fatalf("Unexpected gaps: %v", pairs)
+	}
+	for i := range expected {
+		if pairs[i] != expected[i] {
+			t.Fatalf("Unexpected gap %d: %v", i, pairs[i])
+		}
+	}
+
+	if pairs := rb.WidestGaps(100, gap); len(pairs) != rb.Size()-1 {
+		t.Fatalf("Unexpected number of gaps: %d", len(pairs))
+	}
+	if pairs := rb.WidestGaps(0, gap); len(pairs) != 0 {
+		t.Fatalf("Unexpected gaps for k=0: %v", pairs)
+	}
+}
+
+func TestAscendEvery(t *testing.T) {
+	step := func(item tree.Item) tree.Item {
+		return item.(tree.Int) + 10
+	}
+
+	var rb tree.RedBlackTree
+	rb.AscendEvery(tree.Int(0), step, nil)
+
+	for i := 0; i < 100; i++ {
+		rb.Upsert(tree.Int(i))
+	}
+	var visited []int
+	rb.AscendEvery(tree.Int(5), step, func(item tree.Item) bool {
+		visited = append(visited, int(item.(tree.Int)))
+		return true
+	})
+	expected := []int{5, 15, 25, 35, 45, 55, 65, 75, 85, 95}
+	if len(visited) != len(expected) {
+		t.Fatalf("Unexpected items visited: %v", visited)
+	}
+	for i := range expected {
+		if visited[i] != expected[i] {
+			t.Fatalf("Unexpected item visited: %v", visited)
+		}
+	}
+
+	// Targets sharing the same ceiling visit it only once.
+	var sparse tree.RedBlackTree
+	for _, i := range []int{3, 4, 37, 90} {
+		sparse.Upsert(tree.Int(i))
+	}
+	visited = nil
+	sparse.AscendEvery(tree.Int(0), step, func(item tree.Item) bool {
+		visited = append(visited, int(item.(tree.Int)))
+		return true
+	})
+	expected = []int{3, 37, 90}
+	if len(visited) != len(expected) {
+		t.Fatalf("Unexpected sparse items visited: %v", visited)
+	}
+	for i := range expected {
+		if visited[i] != expected[i] {
+			t.Fatalf("Unexpected sparse item visited: %v", visited)
+		}
+	}
+}
+
+func TestTryGet(t *testing.T) {
+	var rb tree.RedBlackTree
+	if it, err := rb.TryGet(tree.Int(1)); !errors.Is(err, tree.ErrNotFound) || it != nil {
+		t.Fatalf("Unexpected result for empty tree: %v, %v", it, err)
+	}
+
+	rb.Upsert(tree.Int(1))
+	if it, err := rb.TryGet(tree.Int(1)); err != nil || it != tree.Int(1) {
+		t.Fatalf("Unexpected result for present item: %v, %v", it, err)
+	}
+	if it, err := rb.TryGet(tree.Int(2)); !errors.Is(err, tree.ErrNotFound) || it != nil {
+		t.Fatalf("Unexpected result for absent item: %v, %v", it, err)
+	}
+}
+
+func TestPathToRoot(t *testing.T) {
+	var rb tree.RedBlackTree
+	if path := rb.PathToRoot(tree.Int(1)); path != nil {
+		t.Fatalf("Unexpected path for empty tree: %v", path)
+	}
+
+	for i := 0; i < 200; i++ {
+		rb.Upsert(tree.Int((i * 7919) % 200))
+	}
+	levels := make(map[tree.Item]int)
+	var root tree.Item
+	rb.LevelOrder(func(item tree.Item, level int) bool {
+		if level == 0 {
+			root = item
+		}
+		levels[item] = level
+		return true
+	})
+
+	for i := 0; i < 200; i++ {
+		path := rb.PathToRoot(tree.Int(i))
+		if len(path) != levels[tree.Int(i)]+1 {
+			t.Fatalf("Unexpected path length for %d: %d", i, len(path))
+		}
+		if path[0] != tree.Int(i) || path[len(path)-1] != root {
+			t.Fatalf("Unexpected path for %d: %v", i, path)
+		}
+		for j, item := range path {
+			if levels[item] != len(path)-1-j {
+				t.Fatalf("Unexpected item level in path for %d: %v", i, path)
+			}
+		}
+	}
+
+	if path := rb.PathToRoot(tree.Int(500)); path != nil {
+		t.Fatalf("Unexpected path for absent item: %v", path)
+	}
+}
+
+func TestOptimizeLayout(t *testing.T) {
+	var rb tree.RedBlackTree
+	rb.OptimizeLayout()
+
+	const size = 5000
+	for i := 0; i < size; i++ {
+		rb.Upsert(tree.Int((i * 7919) % size))
+	}
+	before := rb.FlattenToArray()
+
+	rb.OptimizeLayout()
+	if err := tree.Verify(&rb); err != nil {
+		t.Fatalf("Invalid tree after optimizing: %v", err)
+	}
+	after := rb.FlattenToArray()
+	if len(after) != len(before) {
+		t.Fatalf("Unexpected number of nodes: %d", len(after))
+	}
+	for i := range before {
+		if after[i] != before[i] {
+			t.Fatalf("Unexpected change in structure at %d: %+v - %+v", i, after[i], before[i])
+		}
+	}
+	for i := 0; i < size; i++ {
+		if rb.Get(tree.Int(i)) != tree.Int(i) {
+			t.Fatalf("Missing item after optimizing: %d", i)
+		}
+	}
+
+	// The tree remains writable.
+	for i := 0; i < size; i += 2 {
+		rb.Delete(tree.Int(i))
+		rb.Upsert(tree.Int(size + i))
+	}
+	if err := tree.Verify(&rb); err != nil {
+		t.Fatalf("Invalid tree after writes: %v", err)
+	}
+}
+
+func BenchmarkOptimizeLayout(b *testing.B) {
+	const size = 1 << 21
+
+	var rb tree.RedBlackTree
+	rng := rand.New(rand.NewSource(1))
+	for _, i := range rng.Perm(size) {
+		rb.Upsert(tree.Int(i))
+	}
+	keys := rng.Perm(size)
+
+	get := func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			rb.Get(tree.Int(keys[i%size]))
+		}
+	}
+	b.Run("Default", get)
+	rb.OptimizeLayout()
+	b.Run("Optimized", get)
+}
+
+func TestAscendNeighbors(t *testing.T) {
+	var rb tree.RedBlackTree
+	rb.AscendNeighbors(nil)
+
+	rb.Upsert(tree.Int(5))
+	rb.AscendNeighbors(func(prev, cur, next tree.Item) bool {
+		if prev != nil || cur != tree.Int(5) || next != nil {
+			t.Fatalf("Unexpected window for single item: %v, %v, %v", prev, cur, next)
+		}
+		return true
+	})
+
+	for i := 0; i < 10; i++ {
+		rb.Upsert(tree.Int(i))
+	}
+	var i int
+	rb.AscendNeighbors(func(prev, cur, next tree.Item) bool {
+		var expPrev, expNext tree.Item
+		if i > 0 {
+			expPrev = tree.Int(i - 1)
+		}
+		if i < 9 {
+			expNext = tree.Int(i + 1)
+		}
+		if prev != expPrev || cur != tree.Int(i) || next != expNext {
+			t.Fatalf("Unexpected window at %d: %v, %v, %v", i, prev, cur, next)
+		}
+		i++
+		return true
+	})
+	if i != 10 {
+		t.Fatalf("Unexpected number of items visited: %d", i)
+	}
+}
+
+func TestSubTree(t *testing.T) {
+	var rb tree.RedBlackTree
+	if sub := rb.SubTree(tree.Int(0), tree.Int(10)); sub.Size() != 0 {
+		t.Fatalf("Unexpected size for empty subtree: %d", sub.Size())
+	}
+
+	for i := 0; i < 1000; i++ {
+		rb.Upsert(tree.Int(i))
+	}
+
+	sub := rb.SubTree(tree.Int(250), tree.Int(750))
+	if err := tree.Verify(sub); err != nil {
+		t.Fatalf("Invalid subtree: %v", err)
+	}
+	var expected []tree.Item
+	rb.AscendRange(tree.Int(250), tree.Int(750), func(item tree.Item) bool {
+		expected = append(expected, item)
+		return true
+	})
+	if sub.Size() != len(expected) {
+		t.Fatalf("Unexpected subtree size: %d", sub.Size())
+	}
+	var i int
+	sub.Ascend(func(item tree.Item) bool {
+		if item != expected[i] {
+			t.Fatalf("Unexpected subtree item: %v - %v", item, expected[i])
+		}
+		i++
+		return true
+	})
+
+	// Modifying either tree does not affect the other.
+	sub.Delete(tree.Int(300))
+	sub.Upsert(tree.Int(5000))
+	rb.Delete(tree.Int(400))
+	if !rb.Exists(tree.Int(300)) || rb.Exists(tree.Int(5000)) || !sub.Exists(tree.Int(400)) {
+		t.Fatal("Unexpected shared state between trees")
+	}
+	if rb.Size() != 999 || sub.Size() != 500 {
+		t.Fatalf("Unexpected sizes: %d, %d", rb.Size(), sub.Size())
+	}
+}
+
+func TestCommonPrefix(t *testing.T) {
+	var rb tree.RedBlackTree
+	if prefix := rb.CommonPrefix(); prefix != "" {
+		t.Fatalf("Unexpected prefix for empty tree: %q", prefix)
+	}
+
+	rb.Upsert(tree.String("interstellar"))
+	if prefix := rb.CommonPrefix(); prefix != "interstellar" {
+		t.Fatalf("Unexpected prefix for single item: %q", prefix)
+	}
+
+	for _, s := range []string{"internet", "interval", "internal", "interview"} {
+		rb.Upsert(tree.String(s))
+	}
+	if prefix := rb.CommonPrefix(); prefix != "inter" {
+		t.Fatalf("Unexpected prefix: %q", prefix)
+	}
+
+	rb.Upsert(tree.String("inter"))
+	if prefix := rb.CommonPrefix(); prefix != "inter" {
+		t.Fatalf("Unexpected prefix with prefix item: %q", prefix)
+	}
+
+	rb.Upsert(tree.String("apple"))
+	if prefix := rb.CommonPrefix(); prefix != "" {
+		t.Fatalf("Unexpected prefix for disjoint items: %q", prefix)
+	}
+}
+
+func TestDrainRange(t *testing.T) {
+	var rb tree.RedBlackTree
+	for i := 0; i < 100; i++ {
+		rb.Upsert(tree.Int(i))
+	}
+
+	var drained []int
+	rb.DrainRange(tree.Int(30), tree.Int(60), func(item tree.Item) bool {
+		drained = append(drained, int(item.(tree.Int)))
+		return len(drained) < 20
+	})
+	if len(drained) != 20 {
+		t.Fatalf("Unexpected number of items drained: %d", len(drained))
+	}
+	for i, v := range drained {
+		if v != 30+i {
+			t.Fatalf("Unexpected drained item: %d - %d", v, 30+i)
+		}
+	}
+	if err := tree.Verify(&rb); err != nil {
+		t.Fatalf("Invalid tree: %v", err)
+	}
+	if rb.Size() != 80 {
+		t.Fatalf("Unexpected size: %d", rb.Size())
+	}
+	for i := 0; i < 100; i++ {
+		exists := rb.Exists(tree.Int(i))
+		if exists != (i < 30 || i >= 50) {
+			t.Fatalf("Unexpected existence of item %d: %t", i, exists)
+		}
+	}
+
+	drained = drained[:0]
+	rb.DrainRange(tree.Int(40), tree.Int(70), func(item tree.Item) bool {
+		drained = append(drained, int(item.(tree.Int)))
+		return true
+	})
+	if len(drained) != 20 || drained[0] != 50 || drained[19] != 69 {
+		t.Fatalf("Unexpected drained items: %v", drained)
+	}
+	if err := tree.Verify(&rb); err != nil {
+		t.Fatalf("Invalid tree: %v", err)
+	}
+	if rb.Size() != 60 {
+		t.Fatalf("Unexpected size: %d", rb.Size())
+	}
+}
+
+func TestDeleteMinUntil(t *testing.T) {
+	var rb tree.RedBlackTree
+	if items := rb.DeleteMinUntil(tree.Int(10)); len(items) != 0 {
+		t.Fatalf("Unexpected items deleted from empty tree: %v", items)
+	}
+
+	for i := 0; i < 100; i++ {
+		rb.Upsert(tree.Int(i))
+	}
+
+	items := rb.DeleteMinUntil(tree.Int(40))
+	if len(items) != 40 {
+		t.Fatalf("Unexpected number of items deleted: %d", len(items))
+	}
+	for i, item := range items {
+		if int(item.(tree.Int)) != i {
+			t.Fatalf("Unexpected deleted item: %v - %d", item, i)
+		}
+	}
+	if err := tree.Verify(&rb); err != nil {
+		t.Fatalf("Invalid tree: %v", err)
+	}
+	if rb.Size() != 60 || rb.Min() != tree.Int(40) {
+		t.Fatalf("Unexpected remaining tree: %d, %v", rb.Size(), rb.Min())
+	}
+
+	if items := rb.DeleteMinUntil(tree.Int(40)); len(items) != 0 {
+		t.Fatalf("Unexpected items deleted at bound: %v", items)
+	}
+	if items := rb.DeleteMinUntil(tree.Int(1000)); len(items) != 60 || rb.Size() != 0 {
+		t.Fatalf("Unexpected result draining tree: %d, %d", len(items), rb.Size())
+	}
+}
+
+func TestLastInsertRotations(t *testing.T) {
+	insert := func(rb *tree.RedBlackTree, items ...int) []int {
+		rotations := make([]int, len(items))
+		for i, item := range items {
+			rb.Upsert(tree.Int(item))
+			rotations[i] = rb.LastInsertRotations()
+		}
+		return rotations
+	}
+	check := func(name string, got, expected []int) {
+		for i := range expected {
+			if got[i] != expected[i] {
+				t.Fatalf("Unexpected rotations for %s: %v - %v", name, got, expected)
+			}
+		}
+	}
+
+	// Sequential inserts require at most a single rotation.
+	rb := tree.NewTracking()
+	check("sequential", insert(rb, 1, 2, 3, 4, 5), []int{0, 0, 1, 0, 1})
+
+	// A zig-zag insert requires a double rotation.
+	rb = tree.NewTracking()
+	check("zig-zag", insert(rb, 3, 1, 2), []int{0, 0, 2})
+
+	// Replacing an item doesn't rotate.
+	check("replace", insert(rb, 2), []int{0})
+
+	var sum int
+	rb = tree.NewTracking()
+	for _, r := range insert(rb, rand.New(rand.NewSource(1)).Perm(1000)...) {
+		if r > 2 {
+			t.Fatalf("Unexpected number of rotations: %d", r)
+		}
+		sum += r
+	}
+	if sum == 0 {
+		t.Fatal("Expected some rotations for random inserts")
+	}
+
+	var untracked tree.RedBlackTree
+	if r := insert(&untracked, 1, 2, 3); r[2] != 0 {
+		t.Fatalf("Unexpected rotations for untracked tree: %v", r)
+	}
+}
+
+func TestMergeSorted(t *testing.T) {
+	for _, size := range []int{0, 10, 1000} {
+		var rb tree.RedBlackTree
+		var inserts int
+		rb.OnInsert(func(item, replaced tree.Item) {
+			inserts++
+		})
+		for i := 0; i < size; i++ {
+			rb.Upsert(tree.Int(i * 2))
+		}
+		inserts = 0
+
+		// Merge a batch overlapping the even items with new odd items.
+		var items []tree.Item
+		for i := size / 2; i < size+50; i++ {
+			items = append(items, tree.Int(i))
+		}
+		var expected int
+		for _, item := range items {
+			if !rb.Exists(item) {
+				expected++
+			}
+		}
+
+		if added := rb.MergeSorted(items); added != expected {
+			t.Fatalf("Unexpected number of items added for size %d: %d - %d", size, added, expected)
+		}
+		if inserts != len(items) {
+			t.Fatalf("Unexpected number of insert hooks for size %d: %d", size, inserts)
+		}
+		if err := tree.Verify(&rb); err != nil {
+			t.Fatalf("Invalid tree for size %d: %v", size, err)
+		}
+		if rb.Size() != size+expected {
+			t.Fatalf("Unexpected size for size %d: %d", size, rb.Size())
+		}
+		for _, item := range items {
+			if !rb.Exists(item) {
+				t.Fatalf("Missing merged item for size %d: %v", size, item)
+			}
+		}
+	}
+
+	// A small batch into a large tree is upserted individually.
+	var rb tree.RedBlackTree
+	for i := 0; i < 1000; i++ {
+		rb.Upsert(tree.Int(i))
+	}
+	if added := rb.MergeSorted([]tree.Item{tree.Int(5), tree.Int(5000)}); added != 1 {
+		t.Fatalf("Unexpected number of items added: %d", added)
+	}
+	if err := tree.Verify(&rb); err != nil {
+		t.Fatalf("Invalid tree: %v", err)
+	}
+
+	once := tree.NewInsertOnce()
+	first := &counter{key: 1}
+	once.Upsert(first)
+	once.MergeSorted([]tree.Item{&counter{key: 0}, &counter{key: 1, count: 1}, &counter{key: 2}})
+	if once.Size() != 3 || once.Get(first) != first {
+		t.Fatalf("Unexpected insert-once merge: %d, %+v", once.Size(), once.Get(first))
+	}
+
+	bounded := tree.NewBounded(tree.Int(0), tree.Int(10))
+	func() {
+		defer func() {
+			if r := recover(); r != tree.ErrOutOfRange {
+				t.Fatalf("Unexpected panic value: %v", r)
+			}
+		}()
+		bounded.MergeSorted([]tree.Item{tree.Int(5), tree.Int(10)})
+	}()
+	if bounded.Size() != 0 {
+		t.Fatalf("Unexpected size after rejected merge: %d", bounded.Size())
+	}
+}
+
+// broken is an Item with a Less method that always returns true.
+type broken int
+
+func (broken) Less(tree.Item) bool {
+	return true
+}
+
+func TestSetMaxHeight(t *testing.T) {
+	// Red-black rebalancing bounds the height of the tree even with a broken
+	// comparator, so use a guard below the bound for 100 items.
+	var rb tree.RedBlackTree
+	rb.SetMaxHeight(5)
+
+	var err error
+	var inserted int
+	for i := 0; i < 100 && err == nil; i++ {
+		if _, err = rb.TryUpsert(broken(i)); err == nil {
+			inserted++
+		}
+	}
+	if err != tree.ErrMaxHeight {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if rb.Size() != inserted {
+		t.Fatalf("Unexpected size after rejected insert: %d - %d", rb.Size(), inserted)
+	}
+	var maxLevel int
+	rb.LevelOrder(func(item tree.Item, level int) bool {
+		maxLevel = level
+		return true
+	})
+	if maxLevel >= 5 {
+		t.Fatalf("Unexpected tree height: %d", maxLevel+1)
+	}
+
+	func() {
+		defer func() {
+			if r := recover(); r != tree.ErrMaxHeight {
+				t.Fatalf("Unexpected panic value: %v", r)
+			}
+		}()
+		rb.Upsert(broken(100))
+	}()
+
+	// MergeSorted keeps the items upserted before the item that failed.
+	var merged tree.RedBlackTree
+	merged.SetMaxHeight(5)
+	for i := 0; i < inserted-1; i++ {
+		merged.Upsert(broken(i))
+	}
+	func() {
+		defer func() {
+			if r := recover(); r != tree.ErrMaxHeight {
+				t.Fatalf("Unexpected panic value: %v", r)
+			}
+		}()
+		merged.MergeSorted([]tree.Item{broken(inserted - 1), broken(inserted)})
+	}()
+	if merged.Size() != inserted {
+		t.Fatalf("Unexpected size after partial merge: %d - %d", merged.Size(), inserted)
+	}
+
+	var unlimited tree.RedBlackTree
+	unlimited.SetMaxHeight(5)
+	unlimited.SetMaxHeight(0)
+	for i := 0; i < 100; i++ {
+		if _, err := unlimited.TryUpsert(tree.Int(i)); err != nil {
+			t.Fatalf("Unexpected error without limit: %v", err)
+		}
+	}
+}
+
+func TestAscendWithStableID(t *testing.T) {
+	rb := tree.NewWithStableIDs()
+	rb.AscendWithStableID(nil)
+
+	collect := func() map[tree.Item]uint64 {
+		ids := make(map[tree.Item]uint64)
+		rb.AscendWithStableID(func(item tree.Item, id uint64) bool {
+			ids[item] = id
+			return true
+		})
+		return ids
+	}
+
+	for i := 0; i < 500; i++ {
+		rb.Upsert(tree.Int((i * 7919) % 500))
+	}
+	before := collect()
+	seen := make(map[uint64]bool)
+	for item, id := range before {
+		if seen[id] {
+			t.Fatalf("Duplicate id %d for %v", id, item)
+		}
+		seen[id] = true
+	}
+
+	// Delete and insert other items, and replace some existing items.
+	for i := 0; i < 500; i += 3 {
+		rb.Delete(tree.Int(i))
+	}
+	for i := 500; i < 700; i++ {
+		rb.Upsert(tree.Int(i))
+	}
+	for i := 1; i < 500; i += 3 {
+		rb.Upsert(tree.Int(i))
+	}
+	rb.RetainIf(func(item tree.Item) bool {
+		return item.(tree.Int)%3 != 2
+	})
+	rb.OptimizeLayout()
+
+	after := collect()
+	for item, id := range after {
+		if item.(tree.Int) >= 500 {
+			if seen[id] {
+				t.Fatalf("Reused id %d for new item %v", id, item)
+			}
+			continue
+		}
+		if before[item] != id {
+			t.Fatalf("Unexpected id change for %v: %d - %d", item, before[item], id)
+		}
+	}
+
+	var plain tree.RedBlackTree
+	plain.Upsert(tree.Int(1))
+	plain.AscendWithStableID(func(item tree.Item, id uint64) bool {
+		if id != 0 {
+			t.Fatalf("Unexpected id without stable IDs: %d", id)
+		}
+		return true
+	})
+}
+
+func TestSubtreeSizeHistogram(t *testing.T) {
+	var rb tree.RedBlackTree
+	if hist := rb.SubtreeSizeHistogram(); len(hist) != 0 {
+		t.Fatalf("Unexpected histogram for empty tree: %v", hist)
+	}
+
+	const size = 1000
+	items := make([]tree.Item, size)
+	for i := range items {
+		items[i] = tree.Int(i)
+	}
+	rb.MergeSorted(items)
+
+	hist := rb.SubtreeSizeHistogram()
+	var nodes int
+	for subtreeSize, count := range hist {
+		if subtreeSize < 1 || subtreeSize > size {
+			t.Fatalf("Unexpected subtree size: %d", subtreeSize)
+		}
+		nodes += count
+	}
+	if nodes != size {
+		t.Fatalf("Unexpected number of nodes in histogram: %d", nodes)
+	}
+	if hist[size] != 1 {
+		t.Fatalf("Unexpected count for root subtree size: %d", hist[size])
+	}
+	// A balanced build has a leaf for roughly every other node.
+	if hist[1] < size/3 {
+		t.Fatalf("Unexpected number of leaves: %d", hist[1])
+	}
+}
+
+func TestMedian(t *testing.T) {
+	var rb tree.RedBlackTree
+	if it := rb.Median(); it != nil {
+		t.Fatalf("Unexpected median for empty tree: %v", it)
+	}
+
+	for size := 1; size <= 50; size++ {
+		rb.Upsert(tree.Int(size * 3))
+		if it := rb.Median(); it != tree.Int((size/2+1)*3) {
+			t.Fatalf("Unexpected median for size %d: %v", size, it)
+		}
+	}
+	if rb.Size() != 50 {
+		t.Fatalf("Unexpected size: %d", rb.Size())
+	}
+}
+
+func TestMissingKeys(t *testing.T) {
+	var rb tree.RedBlackTree
+	if missing := rb.MissingKeys([]tree.Item{tree.Int(1), tree.Int(2)}); len(missing) != 2 {
+		t.Fatalf("Unexpected missing keys for empty tree: %v", missing)
+	}
+
+	for i := 0; i < 100; i += 2 {
+		rb.Upsert(tree.Int(i))
+	}
+
+	var expected, want []tree.Item
+	for i := -5; i < 110; i += 3 {
+		expected = append(expected, tree.Int(i))
+		if i < 0 || i >= 100 || i%2 != 0 {
+			want = append(want, tree.Int(i))
+		}
+	}
+	missing := rb.MissingKeys(expected)
+	if len(missing) != len(want) {
+		t.Fatalf("Unexpected number of missing keys: %d - %d", len(missing), len(want))
+	}
+	for i := range want {
+		if missing[i] != want[i] {
+			t.Fatalf("Unexpected missing key: %v - %v", missing[i], want[i])
+		}
+	}
+
+	if missing := rb.MissingKeys([]tree.Item{tree.Int(0), tree.Int(98)}); len(missing) != 0 {
+		t.Fatalf("Unexpected missing keys: %v", missing)
+	}
+}
+
+func TestBracket(t *testing.T) {
+	var rb tree.RedBlackTree
+	if lower, upper := rb.Bracket(tree.Int(1)); lower != nil || upper != nil {
+		t.Fatalf("Unexpected bracket for empty tree: %v, %v", lower, upper)
+	}
+
+	for i := 10; i <= 100; i += 10 {
+		rb.Upsert(tree.Int(i))
+	}
+
+	tests := []struct {
+		query        int
+		lower, upper tree.Item
+	}{
+		{query: 5, lower: nil, upper: tree.Int(10)},
+		{query: 10, lower: tree.Int(10), upper: tree.Int(10)},
+		{query: 45, lower: tree.Int(40), upper: tree.Int(50)},
+		{query: 70, lower: tree.Int(70), upper: tree.Int(70)},
+		{query: 100, lower: tree.Int(100), upper: tree.Int(100)},
+		{query: 105, lower: tree.Int(100), upper: nil},
+	}
+	for _, test := range tests {
+		lower, upper := rb.Bracket(tree.Int(test.query))
+		if lower != test.lower || upper != test.upper {
+			t.Fatalf("Unexpected bracket for %d: %v, %v", test.query, lower, upper)
+		}
+	}
+}
+
+func TestAdvanceWindow(t *testing.T) {
+	var rb tree.RedBlackTree
+	for i := 0; i < 1000; i++ {
+		evicted := rb.AdvanceWindow(tree.Int(i), 100)
+		if i < 100 {
+			if evicted != nil {
+				t.Fatalf("Unexpected eviction at %d: %v", i, evicted)
+			}
+		} else if evicted != tree.Int(i-100) {
+			t.Fatalf("Unexpected eviction at %d: %v", i, evicted)
+		}
+	}
+	if err := tree.Verify(&rb); err != nil {
+		t.Fatalf("Invalid tree: %v", err)
+	}
+	if rb.Size() != 100 || rb.Min() != tree.Int(900) || rb.Max() != tree.Int(999) {
+		t.Fatalf("Unexpected window: %d, %v, %v", rb.Size(), rb.Min(), rb.Max())
+	}
+}
+
+func TestEqualsSlice(t *testing.T) {
+	var rb tree.RedBlackTree
+	if !rb.EqualsSlice(nil) {
+		t.Fatal("Unexpected inequality for empty tree")
+	}
+
+	var items []tree.Item
+	for i := 0; i < 50; i++ {
+		rb.Upsert(tree.Int(49 - i))
+		items = append(items, tree.Int(i))
+	}
+	if !rb.EqualsSlice(items) {
+		t.Fatal("Unexpected inequality for sorted items")
+	}
+	if rb.EqualsSlice(items[:49]) {
+		t.Fatal("Unexpected equality for shorter slice")
+	}
+
+	items[25] = tree.Int(100)
+	if rb.EqualsSlice(items) {
+		t.Fatal("Unexpected equality for mismatched slice")
+	}
+}
+
+func TestAscendAbsent(t *testing.T) {
+	next := func(item tree.Item) tree.Item { return item.(tree.Int) + 1 }
+
+	var rb tree.RedBlackTree
+	present := map[int]bool{0: true, 7: true, 8: true, 50: true, 99: true}
+	for i := range present {
+		rb.Upsert(tree.Int(i))
+	}
+	rb.Upsert(tree.Int(-10))
+	rb.Upsert(tree.Int(150))
+
+	var absent []int
+	rb.AscendAbsent(tree.Int(0), tree.Int(99), next, func(item tree.Item) bool {
+		absent = append(absent, int(item.(tree.Int)))
+		return true
+	})
+	if len(absent) != 100-len(present) {
+		t.Fatalf("Unexpected number of absent keys: %d", len(absent))
+	}
+	i := 0
+	for _, v := range absent {
+		for present[i] {
+			i++
+		}
+		if v != i {
+			t.Fatalf("Unexpected absent key: %d - %d", v, i)
+		}
+		i++
+	}
+
+	var count int
+	rb.AscendAbsent(tree.Int(0), tree.Int(99), next, func(item tree.Item) bool {
+		count++
+		return count < 3
+	})
+	if count != 3 {
+		t.Fatalf("Unexpected number of keys visited: %d", count)
+	}
+}
+
+func TestUnionSizeEstimate(t *testing.T) {
+	var a, b, union tree.RedBlackTree
+	if size := a.UnionSizeEstimate(&b); size != 0 {
+		t.Fatalf("Unexpected size for empty trees: %d", size)
+	}
+
+	for i := 0; i < 100; i += 2 {
+		a.Upsert(tree.Int(i))
+		union.Upsert(tree.Int(i))
+	}
+	for i := 50; i < 200; i += 3 {
+		b.Upsert(tree.Int(i))
+		union.Upsert(tree.Int(i))
+	}
+	if size := a.UnionSizeEstimate(&b); size != union.Size() {
+		t.Fatalf("Unexpected union size: %d - %d", size, union.Size())
+	}
+	if size := b.UnionSizeEstimate(&a); size != union.Size() {
+		t.Fatalf("Unexpected union size: %d - %d", size, union.Size())
+	}
+	if size := a.UnionSizeEstimate(&a); size != a.Size() {
+		t.Fatalf("Unexpected union size with self: %d - %d", size, a.Size())
+	}
+}
+
+func TestEdges(t *testing.T) {
+	type edge struct {
+		parent, child tree.Item
+		isLeft        bool
+	}
+
+	var rb tree.RedBlackTree
+	var edges []edge
+	collect := func(parent, child tree.Item, isLeft bool) bool {
+		edges = append(edges, edge{parent, child, isLeft})
+		return true
+	}
+	rb.Edges(collect)
+	if len(edges) != 0 {
+		t.Fatalf("Unexpected edges for empty tree: %v", edges)
+	}
+
+	rb.Upsert(tree.Int(2))
+	rb.Upsert(tree.Int(1))
+	rb.Upsert(tree.Int(3))
+	rb.Upsert(tree.Int(4))
+	rb.Edges(collect)
+	expected := []edge{
+		{tree.Int(2), tree.Int(1), true},
+		{tree.Int(2), tree.Int(3), false},
+		{tree.Int(3), tree.Int(4), false},
+	}
+	if len(edges) != len(expected) {
+		t.Fatalf("Unexpected number of edges: %d", len(edges))
+	}
+	for i := range expected {
+		if edges[i] != expected[i] {
+			t.Fatalf("Unexpected edge: %v - %v", edges[i], expected[i])
+		}
+	}
+
+	var count int
+	rb.Edges(func(parent, child tree.Item, isLeft bool) bool {
+		count++
+		return false
+	})
+	if count != 1 {
+		t.Fatalf("Unexpected number of edges visited: %d", count)
+	}
+}
+
+func TestDeleteOK(t *testing.T) {
+	var rb tree.RedBlackTree
+	if item, ok := rb.DeleteOK(tree.Int(1)); ok || item != nil {
+		t.Fatalf("Unexpected delete from empty tree: %v, %t", item, ok)
+	}
+
+	for i := 0; i < 10; i++ {
+		rb.Upsert(tree.Int(i))
+	}
+	if item, ok := rb.DeleteOK(tree.Int(5)); !ok || item != tree.Int(5) {
+		t.Fatalf("Unexpected delete of present item: %v, %t", item, ok)
+	}
+	if item, ok := rb.DeleteOK(tree.Int(5)); ok || item != nil {
+		t.Fatalf("Unexpected delete of absent item: %v, %t", item, ok)
+	}
+	if err := tree.Verify(&rb); err != nil {
+		t.Fatalf("Invalid tree: %v", err)
+	}
+	if rb.Size() != 9 {
+		t.Fatalf("Unexpected size: %d", rb.Size())
+	}
+}
+
+func TestAscendRanked(t *testing.T) {
+	var rb tree.RedBlackTree
+	for _, i := range rand.Perm(100) {
+		rb.Upsert(tree.Int(i * 2))
+	}
+
+	var count int
+	rb.AscendRanked(func(rank int, item tree.Item) bool {
+		var less int
+		rb.AscendLess(item, func(tree.Item) bool {
+			less++
+			return true
+		})
+		if rank != less || rank != count {
+			t.Fatalf("Unexpected rank for %v: %d - %d", item, rank, less)
+		}
+		count++
+		return true
+	})
+	if count != 100 {
+		t.Fatalf("Unexpected number of items visited: %d", count)
+	}
+
+	count = 0
+	rb.AscendRanked(func(rank int, item tree.Item) bool {
+		count++
+		return rank < 9
+	})
+	if count != 10 {
+		t.Fatalf("Unexpected number of items visited: %d", count)
+	}
+}
+
+func TestUpsertNear(t *testing.T) {
+	var rb tree.RedBlackTree
+	rng := rand.New(rand.NewSource(1))
+	var prev tree.Item = tree.Int(0)
+	for i := 0; i < 5000; i++ {
+		var item tree.Item
+		if rng.Intn(4) == 0 {
+			item = tree.Int(rng.Intn(10000))
+		} else {
+			item = prev.(tree.Int) + tree.Int(rng.Intn(21)-10)
+		}
+		hint := prev
+		if rng.Intn(10) == 0 {
+			hint = tree.Int(rng.Intn(10000))
+		}
+		expected := rb.Get(item)
+		if old := rb.UpsertNear(hint, item); old != expected {
+			t.Fatalf("Unexpected replaced item: %v - %v", old, expected)
+		}
+		if !rb.Exists(item) {
+			t.Fatalf("Missing upserted item: %v", item)
+		}
+		if rng.Intn(5) == 0 {
+			rb.Delete(tree.Int(rng.Intn(10000)))
+		}
+		prev = item
+	}
+	if err := tree.Verify(&rb); err != nil {
+		t.Fatalf("Invalid tree: %v", err)
+	}
+
+	var count int
+	var last tree.Item
+	rb.Ascend(func(item tree.Item) bool {
+		if last != nil && !last.Less(item) {
+			t.Fatalf("Unexpected order: %v, %v", last, item)
+		}
+		last = item
+		count++
+		return true
+	})
+	if count != rb.Size() {
+		t.Fatalf("Unexpected size: %d - %d", count, rb.Size())
+	}
+}
+
+func benchmarkUpsertClustered(b *testing.B, near bool) {
+	const size = 1 << 16
+	const cluster = 64
+
+	var calls int
+	var rb tree.RedBlackTree
+	for i := 0; i < size; i++ {
+		rb.Upsert(expensive{key: i * 2, calls: &calls})
+	}
+	var keys []int
+	for _, c := range rand.New(rand.NewSource(1)).Perm(size / cluster) {
+		for i := 0; i < cluster; i++ {
+			keys = append(keys, (c*cluster+i)*2+1)
+		}
+	}
+
+	calls = 0
+	b.ResetTimer()
+	var prev tree.Item = expensive{calls: &calls}
+	for i := 0; i < b.N; i++ {
+		item := expensive{key: keys[i%len(keys)], calls: &calls}
+		if near {
+			rb.UpsertNear(prev, item)
+		} else {
+			rb.Upsert(item)
+		}
+		prev = item
+	}
+	b.ReportMetric(float64(calls)/float64(b.N), "comparisons/op")
+}
+
+func BenchmarkUpsertClustered(b *testing.B) {
+	benchmarkUpsertClustered(b, false)
+}
+
+func BenchmarkUpsertNearClustered(b *testing.B) {
+	benchmarkUpsertClustered(b, true)
+}
+
+func TestShuffledSlice(t *testing.T) {
+	var rb tree.RedBlackTree
+	if items := rb.ShuffledSlice(rand.New(rand.NewSource(1))); len(items) != 0 {
+		t.Fatalf("Unexpected items for empty tree: %v", items)
+	}
+
+	for i := 0; i < 100; i++ {
+		rb.Upsert(tree.Int(i))
+	}
+	items := rb.ShuffledSlice(rand.New(rand.NewSource(42)))
+	again := rb.ShuffledSlice(rand.New(rand.NewSource(42)))
+	if len(items) != 100 || len(again) != 100 {
+		t.Fatalf("Unexpected number of items: %d, %d", len(items), len(again))
+	}
+	seen := make(map[tree.Item]bool)
+	var moved int
+	for i := range items {
+		if items[i] != again[i] {
+			t.Fatalf("Unexpected non-deterministic shuffle at %d: %v - %v", i, items[i], again[i])
+		}
+		if items[i] != tree.Int(i) {
+			moved++
+		}
+		if !rb.Exists(items[i]) {
+			t.Fatalf("Unexpected shuffled item: %v", items[i])
+		}
+		seen[items[i]] = true
+	}
+	if len(seen) != 100 {
+		t.Fatalf("Unexpected shuffle, not a permutation: %v", items)
+	}
+	if moved == 0 {
+		t.Fatal("Unexpected unshuffled items")
+	}
+}
+
+func TestMinByMaxBy(t *testing.T) {
+	metric := func(item tree.Item) float64 {
+		d := float64(item.(tree.Int) - 37)
+		return d * d
+	}
+
+	var rb tree.RedBlackTree
+	if item := rb.MinBy(metric); item != nil {
+		t.Fatalf("Unexpected MinBy for empty tree: %v", item)
+	}
+	if item := rb.MaxBy(metric); item != nil {
+		t.Fatalf("Unexpected MaxBy for empty tree: %v", item)
+	}
+
+	for i := 0; i < 100; i += 2 {
+		rb.Upsert(tree.Int(i))
+	}
+	// Both 36 and 38 are at distance 1 from 37.
+	if item := rb.MinBy(metric); item != tree.Int(36) {
+		t.Fatalf("Unexpected MinBy: %v", item)
+	}
+	if item := rb.MaxBy(metric); item != tree.Int(98) {
+		t.Fatalf("Unexpected MaxBy: %v", item)
+	}
+	if item := rb.MaxBy(func(tree.Item) float64 { return 1 }); item != tree.Int(0) {
+		t.Fatalf("Unexpected MaxBy for equal metrics: %v", item)
+	}
+}
+
+func TestAscendUntil(t *testing.T) {
+	var rb tree.RedBlackTree
+	for i := 0; i < 100; i++ {
+		rb.Upsert(tree.Int(i))
+	}
+
+	var visited int
+	item := rb.AscendUntil(func(item tree.Item) bool {
+		visited++
+		return item.(tree.Int)%17 == 16
+	})
+	if item != tree.Int(16) || visited != 17 {
+		t.Fatalf("Unexpected stopping item: %v, %d", item, visited)
+	}
+
+	item = rb.AscendUntil(func(item tree.Item) bool {
+		return item.(tree.Int) > 100
+	})
+	if item != nil {
+		t.Fatalf("Unexpected stopping item: %v", item)
+	}
+}
+
+func TestLevelWidths(t *testing.T) {
+	var rb tree.RedBlackTree
+	if widths := rb.LevelWidths(); widths == nil || len(widths) != 0 {
+		t.Fatalf("Unexpected widths for empty tree: %v", widths)
+	}
+
+	items := make([]tree.Item, 1000)
+	for i := range items {
+		items[i] = tree.Int(i)
+	}
+	rb.MergeSorted(items)
+
+	widths := rb.LevelWidths()
+	if len(widths) != 10 {
+		t.Fatalf("Unexpected number of levels: %d", len(widths))
+	}
+	var total int
+	for depth, width := range widths {
+		if depth < len(widths)-1 && width != 1<<uint(depth) {
+			t.Fatalf("Unexpected width at depth %d: %d", depth, width)
+		}
+		total += width
+	}
+	if total != 1000 {
+		t.Fatalf("Unexpected total width: %d", total)
+	}
+}
+
+func TestEqualStreaming(t *testing.T) {
+	var a, b tree.RedBlackTree
+	for i := 0; i < 100; i++ {
+		a.Upsert(tree.Int(i))
+		b.Upsert(tree.Int(i))
+	}
+	if !a.EqualStreaming(&b, nil) {
+		t.Fatal("Unexpected inequality for equal trees")
+	}
+
+	a.Delete(tree.Int(10))
+	a.Upsert(tree.Int(150))
+	b.Delete(tree.Int(0))
+	b.Delete(tree.Int(50))
+
+	type diff struct {
+		item tree.Item
+		side int
+	}
+	var diffs []diff
+	eq := a.EqualStreaming(&b, func(item tree.Item, side int) {
+		diffs = append(diffs, diff{item, side})
+	})
+	if eq {
+		t.Fatal("Unexpected equality for differing trees")
+	}
+	expected := []diff{
+		{tree.Int(0), -1},
+		{tree.Int(10), 1},
+		{tree.Int(50), -1},
+		{tree.Int(150), -1},
+	}
+	if len(diffs) != len(expected) {
+		t.Fatalf("Unexpected number of diffs: %v", diffs)
+	}
+	for i := range expected {
+		if diffs[i] != expected[i] {
+			t.Fatalf("Unexpected diff: %v - %v", diffs[i], expected[i])
+		}
+	}
+}
+
+func TestCanonicalize(t *testing.T) {
+	var rb tree.RedBlackTree
+	first := &counter{key: 1}
+	if item := rb.Canonicalize(first); item != first {
+		t.Fatalf("Unexpected canonical item: %v", item)
+	}
+	for i := 0; i < 10; i++ {
+		if item := rb.Canonicalize(&counter{key: 1, count: i}); item != first {
+			t.Fatalf("Unexpected canonical item: %v", item)
+		}
+	}
+	other := &counter{key: 2}
+	if item := rb.Canonicalize(other); item != other {
+		t.Fatalf("Unexpected canonical item: %v", item)
+	}
+	if rb.Size() != 2 || rb.Get(&counter{key: 1}) != first {
+		t.Fatalf("Unexpected tree after canonicalizing: %d", rb.Size())
+	}
+}
+
+func TestNearestBoth(t *testing.T) {
+	dist := func(a, b tree.Item) float64 {
+		d := float64(a.(tree.Int) - b.(tree.Int))
+		if d < 0 {
+			return -d
+		}
+		return d
+	}
+
+	var rb tree.RedBlackTree
+	for i := 10; i <= 100; i += 10 {
+		rb.Upsert(tree.Int(i))
+	}
+
+	below, belowDist, above, aboveDist := rb.NearestBoth(tree.Int(43), dist)
+	if below != tree.Int(40) || belowDist != 3 || above != tree.Int(50) || aboveDist != 7 {
+		t.Fatalf("Unexpected neighbours: %v, %v, %v, %v", below, belowDist, above, aboveDist)
+	}
+
+	below, belowDist, above, aboveDist = rb.NearestBoth(tree.Int(60), dist)
+	if below != tree.Int(60) || belowDist != 0 || above != tree.Int(60) || aboveDist != 0 {
+		t.Fatalf("Unexpected neighbours: %v, %v, %v, %v", below, belowDist, above, aboveDist)
+	}
+
+	below, belowDist, above, aboveDist = rb.NearestBoth(tree.Int(5), dist)
+	if below != nil || !math.IsInf(belowDist, 1) || above != tree.Int(10) || aboveDist != 5 {
+		t.Fatalf("Unexpected neighbours: %v, %v, %v, %v", below, belowDist, above, aboveDist)
+	}
+
+	below, belowDist, above, aboveDist = rb.NearestBoth(tree.Int(120), dist)
+	if below != tree.Int(100) || belowDist != 20 || above != nil || !math.IsInf(aboveDist, 1) {
+		t.Fatalf("Unexpected neighbours: %v, %v, %v, %v", below, belowDist, above, aboveDist)
+	}
+}
+
+func TestLazyDelete(t *testing.T) {
+	rb := tree.NewLazyDelete()
+	for i := 0; i < 1000; i++ {
+		rb.Upsert(tree.Int(i))
+	}
+	for i := 0; i < 1000; i += 2 {
+		if item := rb.Delete(tree.Int(i)); item != tree.Int(i) {
+			t.Fatalf("Unexpected deleted item: %v - %d", item, i)
+		}
+	}
+	if item := rb.Delete(tree.Int(0)); item != nil {
+		t.Fatalf("Unexpected deletion of tombstoned item: %v", item)
+	}
+	if item := rb.DeleteMax(); item != tree.Int(999) {
+		t.Fatalf("Unexpected max item: %v", item)
+	}
+	if err := tree.Verify(rb); err != nil {
+		t.Fatalf("Invalid tree: %v", err)
+	}
+	if rb.Size() != 499 {
+		t.Fatalf("Unexpected size: %d", rb.Size())
+	}
+	if rb.Min() != tree.Int(1) || rb.Max() != tree.Int(997) {
+		t.Fatalf("Unexpected min and max: %v, %v", rb.Min(), rb.Max())
+	}
+	if rb.Exists(tree.Int(500)) || !rb.Exists(tree.Int(501)) {
+		t.Fatal("Unexpected existence of items")
+	}
+	if lower, upper := rb.Bracket(tree.Int(500)); lower != tree.Int(499) || upper != tree.Int(501) {
+		t.Fatalf("Unexpected bracket of tombstoned item: %v, %v", lower, upper)
+	}
+
+	expected := 1
+	rb.Ascend(func(item tree.Item) bool {
+		if item != tree.Int(expected) {
+			t.Fatalf("Unexpected item: %v - %d", item, expected)
+		}
+		expected += 2
+		return true
+	})
+	if expected != 999 {
+		t.Fatalf("Unexpected number of items visited: %d", expected)
+	}
+
+	// Re-inserting a tombstoned item reuses its node.
+	if old := rb.Upsert(tree.Int(500)); old != nil {
+		t.Fatalf("Unexpected replaced item: %v", old)
+	}
+	if !rb.Exists(tree.Int(500)) || rb.Size() != 500 {
+		t.Fatalf("Unexpected tree after re-insert: %d", rb.Size())
+	}
+	if err := tree.Verify(rb); err != nil {
+		t.Fatalf("Invalid tree: %v", err)
+	}
+
+	if removed := rb.Compact(); removed != 500 {
+		t.Fatalf("Unexpected number of tombstones removed: %d", removed)
+	}
+	if err := tree.Verify(rb); err != nil {
+		t.Fatalf("Invalid tree: %v", err)
+	}
+	if rb.Size() != 500 || rb.Min() != tree.Int(1) || rb.Max() != tree.Int(997) {
+		t.Fatalf("Unexpected tree after compacting: %d, %v, %v", rb.Size(), rb.Min(), rb.Max())
+	}
+	if removed := rb.Compact(); removed != 0 {
+		t.Fatalf("Unexpected number of tombstones removed: %d", removed)
+	}
+}
+
+func TestWithPreview(t *testing.T) {
+	var rb tree.RedBlackTree
+	for i := 0; i < 10; i++ {
+		rb.Upsert(tree.Int(i * 10))
+	}
+	collect := func(v tree.PreviewView) []tree.Item {
+		var items []tree.Item
+		v.Ascend(func(item tree.Item) bool {
+			items = append(items, item)
+			return true
+		})
+		return items
+	}
+	expectItems := func(items []tree.Item, expected ...int) {
+		if len(items) != len(expected) {
+			t.Fatalf("Unexpected preview items: %v - %v", items, expected)
+		}
+		for i := range expected {
+			if items[i] != tree.Int(expected[i]) {
+				t.Fatalf("Unexpected preview items: %v - %v", items, expected)
+			}
+		}
+	}
+
+	v := rb.WithPreview(tree.Operation{Item: tree.Int(45)})
+	expectItems(collect(v), 0, 10, 20, 30, 40, 45, 50, 60, 70, 80, 90)
+	if v.Size() != 11 || v.Get(tree.Int(45)) != tree.Int(45) || v.Get(tree.Int(50)) != tree.Int(50) {
+		t.Fatalf("Unexpected preview: %d", v.Size())
+	}
+	if rb.Size() != 10 || rb.Exists(tree.Int(45)) {
+		t.Fatalf("Unexpected change to base tree: %d", rb.Size())
+	}
+	if err := tree.Verify(&rb); err != nil {
+		t.Fatalf("Invalid tree: %v", err)
+	}
+
+	expectItems(collect(rb.WithPreview(tree.Operation{Item: tree.Int(-5)})), -5, 0, 10, 20, 30, 40, 50, 60, 70, 80, 90)
+	expectItems(collect(rb.WithPreview(tree.Operation{Item: tree.Int(95)})), 0, 10, 20, 30, 40, 50, 60, 70, 80, 90, 95)
+	expectItems(collect(rb.WithPreview(tree.Operation{Item: tree.Int(50)})), 0, 10, 20, 30, 40, 50, 60, 70, 80, 90)
+
+	v = rb.WithPreview(tree.Operation{Item: tree.Int(50), Delete: true})
+	expectItems(collect(v), 0, 10, 20, 30, 40, 60, 70, 80, 90)
+	if v.Size() != 9 || v.Get(tree.Int(50)) != nil {
+		t.Fatalf("Unexpected preview: %d", v.Size())
+	}
+	if rb.Size() != 10 || !rb.Exists(tree.Int(50)) {
+		t.Fatalf("Unexpected change to base tree: %d", rb.Size())
+	}
+
+	v = rb.WithPreview(tree.Operation{Item: tree.Int(55), Delete: true})
+	expectItems(collect(v), 0, 10, 20, 30, 40, 50, 60, 70, 80, 90)
+	if v.Size() != 10 {
+		t.Fatalf("Unexpected preview size: %d", v.Size())
+	}
+
+	agg := tree.NewAggregating(func(old, new tree.Item) tree.Item {
+		return &counter{key: old.(*counter).key, count: old.(*counter).count + new.(*counter).count}
+	})
+	agg.Upsert(&counter{key: 1, count: 2})
+	item := agg.WithPreview(tree.Operation{Item: &counter{key: 1, count: 3}}).Get(&counter{key: 1})
+	if item.(*counter).count != 5 || agg.Get(&counter{key: 1}).(*counter).count != 2 {
+		t.Fatalf("Unexpected aggregated preview: %v", item)
+	}
+
+	// The view reflects changes made to the tree after it is created.
+	v = rb.WithPreview(tree.Operation{Item: tree.Int(50), Delete: true})
+	rb.Delete(tree.Int(50))
+	rb.Upsert(tree.Int(100))
+	expectItems(collect(v), 0, 10, 20, 30, 40, 60, 70, 80, 90, 100)
+	if v.Size() != 10 {
+		t.Fatalf("Unexpected preview size after change: %d", v.Size())
+	}
+	v = rb.WithPreview(tree.Operation{Item: tree.Int(45)})
+	rb.Upsert(tree.Int(45))
+	expectItems(collect(v), 0, 10, 20, 30, 40, 45, 60, 70, 80, 90, 100)
+	if v.Size() != 11 {
+		t.Fatalf("Unexpected preview size after change: %d", v.Size())
+	}
+
+	// Reading a preview does not count as an access.
+	tracking := tree.NewTracking()
+	tracking.Upsert(tree.Int(1))
+	tracking.WithPreview(tree.Operation{Item: tree.Int(1)}).Get(tree.Int(1))
+	tracking.WithPreview(tree.Operation{Item: tree.Int(2)}).Get(tree.Int(1))
+	if hot := tracking.HotKeys(1); len(hot) != 0 {
+		t.Fatalf("Unexpected hot keys after preview: %v", hot)
+	}
+}
+
+func TestMap(t *testing.T) {
+	var rb tree.RedBlackTree
+	for i := -50; i < 50; i++ {
+		rb.Upsert(tree.Int(i))
+	}
+
+	if changed := rb.Map(func(item tree.Item) tree.Item { return item.(tree.Int) * 2 }); changed != 99 {
+		t.Fatalf("Unexpected number of changed items: %d", changed)
+	}
+	if err := tree.Verify(&rb); err != nil {
+		t.Fatalf("Invalid tree: %v", err)
+	}
+	expected := -100
+	rb.Ascend(func(item tree.Item) bool {
+		if item != tree.Int(expected) {
+			t.Fatalf("Unexpected item: %v - %d", item, expected)
+		}
+		expected += 2
+		return true
+	})
+	if expected != 100 {
+		t.Fatalf("Unexpected number of items: %d", rb.Size())
+	}
+
+	// Negating reverses the order of the items.
+	rb.Map(func(item tree.Item) tree.Item { return -item.(tree.Int) })
+	if err := tree.Verify(&rb); err != nil {
+		t.Fatalf("Invalid tree: %v", err)
+	}
+	if rb.Size() != 100 || rb.Min() != tree.Int(-98) || rb.Max() != tree.Int(100) {
+		t.Fatalf("Unexpected tree: %d, %v, %v", rb.Size(), rb.Min(), rb.Max())
+	}
+
+	var deleted int
+	rb.OnDelete(func(tree.Item) { deleted++ })
+	changed := rb.Map(func(item tree.Item) tree.Item { return item.(tree.Int) / 10 })
+	if err := tree.Verify(&rb); err != nil {
+		t.Fatalf("Invalid tree: %v", err)
+	}
+	if changed != 99 || rb.Size() != 20 || deleted != 80 {
+		t.Fatalf("Unexpected result of collapsing map: %d, %d, %d", changed, rb.Size(), deleted)
+	}
+
+	// The hook reports the original items that were removed.
+	var halves tree.RedBlackTree
+	for i := 0; i < 6; i++ {
+		halves.Upsert(tree.Int(i))
+	}
+	var removed []tree.Item
+	halves.OnDelete(func(item tree.Item) { removed = append(removed, item) })
+	halves.Map(func(item tree.Item) tree.Item { return item.(tree.Int) / 2 })
+	if len(removed) != 3 || removed[0] != tree.Int(1) || removed[1] != tree.Int(3) || removed[2] != tree.Int(5) {
+		t.Fatalf("Unexpected removed items: %v", removed)
+	}
+	if !halves.EqualsSlice([]tree.Item{tree.Int(0), tree.Int(1), tree.Int(2)}) {
+		t.Fatalf("Unexpected mapped items: %d", halves.Size())
+	}
+}
+
+func TestDiffRebalance(t *testing.T) {
+	ops := func(keys ...int) []tree.Operation {
+		ops := make([]tree.Operation, len(keys))
+		for i, key := range keys {
+			ops[i] = tree.Operation{Item: tree.Int(key)}
+		}
+		return ops
+	}
+
+	asc, desc := ops(1, 2, 3, 4), ops(4, 3, 2, 1)
+	if tree.DiffRebalance(asc, asc) {
+		t.Fatal("Unexpected difference for equal operations")
+	}
+	if !tree.DiffRebalance(asc, desc) {
+		t.Fatal("Expected different structure for reversed insert order")
+	}
+
+	// Despite the different structure, the content is equal.
+	var a, b tree.RedBlackTree
+	for _, op := range asc {
+		a.Upsert(op.Item)
+	}
+	for _, op := range desc {
+		b.Upsert(op.Item)
+	}
+	if !a.EqualStreaming(&b, nil) {
+		t.Fatal("Unexpected difference in content")
+	}
+
+	withDelete := append(ops(1, 2, 3, 4), tree.Operation{Item: tree.Int(5), Delete: true})
+	if tree.DiffRebalance(withDelete, asc) {
+		t.Fatal("Unexpected difference after deleting a missing item")
+	}
+	// Deleting 4 leaves 1 and 3 black, unlike only inserting 1, 2 and 3.
+	withDelete = append(ops(1, 2, 3, 4), tree.Operation{Item: tree.Int(4), Delete: true})
+	if !tree.DiffRebalance(withDelete, ops(1, 2, 3)) {
+		t.Fatal("Expected difference in colour")
+	}
+	if !tree.DiffRebalance(ops(1, 2, 3), asc) {
+		t.Fatal("Expected difference for different content")
+	}
+}
+
+func TestNthFrom(t *testing.T) {
+	var rb tree.RedBlackTree
+	if item := rb.NthFrom(tree.Int(0), 0); item != nil {
+		t.Fatalf("Unexpected item for empty tree: %v", item)
+	}
+
+	for i := 0; i < 100; i += 2 {
+		rb.Upsert(tree.Int(i))
+	}
+	tests := []struct {
+		start, n int
+		item     tree.Item
+	}{
+		{start: 50, n: 0, item: tree.Int(50)},
+		{start: 49, n: 0, item: tree.Int(50)},
+		{start: 49, n: 3, item: tree.Int(56)},
+		{start: 50, n: -3, item: tree.Int(44)},
+		{start: 51, n: -1, item: tree.Int(50)},
+		{start: 50, n: 24, item: tree.Int(98)},
+		{start: 50, n: 25, item: nil},
+		{start: 50, n: -25, item: tree.Int(0)},
+		{start: 50, n: -26, item: nil},
+		{start: 99, n: -1, item: nil},
+	}
+	for _, test := range tests {
+		if item := rb.NthFrom(tree.Int(test.start), test.n); item != test.item {
+			t.Fatalf("Unexpected item %d from %d: %v - %v", test.n, test.start, item, test.item)
+		}
+	}
+}
+
+type interval struct {
+	lo, hi int
+}
+
+func (i interval) Less(than tree.Item) bool {
+	o := than.(interval)
+	return i.lo < o.lo || (i.lo == o.lo && i.hi < o.hi)
+}
+
+func TestCoalesce(t *testing.T) {
+	canMerge := func(a, b tree.Item) bool {
+		return a.(interval).hi >= b.(interval).lo
+	}
+	merge := func(a, b tree.Item) tree.Item {
+		merged := a.(interval)
+		if hi := b.(interval).hi; hi > merged.hi {
+			merged.hi = hi
+		}
+		return merged
+	}
+
+	var rb tree.RedBlackTree
+	for _, i := range []interval{
+		{19, 25}, {1, 3}, {8, 10}, {2, 6}, {30, 31}, {15, 18}, {9, 12}, {17, 20}, {3, 4},
+	} {
+		rb.Upsert(i)
+	}
+	if merges := rb.Coalesce(canMerge, merge); merges != 5 {
+		t.Fatalf("Unexpected number of merges: %d", merges)
+	}
+	if err := tree.Verify(&rb); err != nil {
+		t.Fatalf("Invalid tree: %v", err)
+	}
+	expected := []tree.Item{interval{1, 6}, interval{8, 12}, interval{15, 25}, interval{30, 31}}
+	if !rb.EqualsSlice(expected) {
+		var got []tree.Item
+		rb.Ascend(func(item tree.Item) bool {
+			got = append(got, item)
+			return true
+		})
+		t.Fatalf("Unexpected coalesced intervals: %v", got)
+	}
+	if merges := rb.Coalesce(canMerge, merge); merges != 0 {
+		t.Fatalf("Unexpected number of merges: %d", merges)
+	}
+
+	// Merged items ordered away from their pair leave the pair's neighbours
+	// adjacent, which must be checked again.
+	sevens := func(a, b tree.Item) bool {
+		return (a.(tree.Int)+b.(tree.Int))%7 == 0
+	}
+	product := func(a, b tree.Item) tree.Item {
+		return a.(tree.Int)*b.(tree.Int) + 88
+	}
+	rb = tree.RedBlackTree{}
+	for _, i := range []tree.Int{0, 3, 4, 7} {
+		rb.Upsert(i)
+	}
+	if merges := rb.Coalesce(sevens, product); merges != 2 {
+		t.Fatalf("Unexpected number of merges: %d", merges)
+	}
+	if !rb.EqualsSlice([]tree.Item{tree.Int(88), tree.Int(100)}) {
+		t.Fatalf("Unexpected coalesced items: %v, %v", rb.Min(), rb.Max())
+	}
+
+	// Merged items equal to an unrelated item are rejected.
+	adjacent := func(a, b tree.Item) bool {
+		return b.(tree.Int)-a.(tree.Int) == 1
+	}
+	sum := func(a, b tree.Item) tree.Item {
+		return a.(tree.Int) + b.(tree.Int) + 7
+	}
+	for _, rb := range []*tree.RedBlackTree{new(tree.RedBlackTree), tree.NewInsertOnce()} {
+		for _, i := range []tree.Int{1, 2, 10} {
+			rb.Upsert(i)
+		}
+		if merges := rb.Coalesce(adjacent, sum); merges != 0 {
+			t.Fatalf("Unexpected number of merges: %d", merges)
+		}
+		if !rb.EqualsSlice([]tree.Item{tree.Int(1), tree.Int(2), tree.Int(10)}) {
+			t.Fatalf("Unexpected size after rejected merge: %d", rb.Size())
+		}
+	}
+
+	// Merged items that cannot be inserted leave the pair in the tree.
+	bounded := tree.NewBounded(tree.Int(0), tree.Int(20))
+	for _, i := range []tree.Int{1, 2, 10} {
+		bounded.Upsert(i)
+	}
+	outside := func(a, b tree.Item) tree.Item {
+		return a.(tree.Int) + b.(tree.Int) + 20
+	}
+	if merges := bounded.Coalesce(adjacent, outside); merges != 0 {
+		t.Fatalf("Unexpected number of merges: %d", merges)
+	}
+	if !bounded.EqualsSlice([]tree.Item{tree.Int(1), tree.Int(2), tree.Int(10)}) {
+		t.Fatalf("Unexpected size after rejected merge: %d", bounded.Size())
+	}
+}
+
+func TestAscendCtx(t *testing.T) {
+	var rb tree.RedBlackTree
+	for i := 0; i < 10000; i++ {
+		rb.Upsert(tree.Int(i))
+	}
+
+	var count int
+	if err := rb.AscendCtx(context.Background(), func(tree.Item) bool {
+		count++
+		return true
+	}); err != nil || count != 10000 {
+		t.Fatalf("Unexpected result: %v, %d", err, count)
+	}
+
+	for _, interval := range []int{0, 1, 10, 1000} {
+		rb.SetCtxCheckInterval(interval)
+		if interval == 0 {
+			interval = tree.DefaultCtxCheckInterval
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		count = 0
+		err := rb.AscendCtx(ctx, func(tree.Item) bool {
+			count++
+			if count == 100 {
+				cancel()
+			}
+			return true
+		})
+		if err != context.Canceled {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if count < 100 || count > 100+interval {
+			t.Fatalf("Unexpected number of items visited with interval %d: %d", interval, count)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	count = 0
+	if err := rb.AscendCtx(ctx, func(tree.Item) bool {
+		count++
+		return true
+	}); err != context.Canceled || count != 0 {
+		t.Fatalf("Unexpected result for cancelled context: %v, %d", err, count)
+	}
+}
+
+func TestKeyMidpoint(t *testing.T) {
+	mid := func(a, b tree.Item) tree.Item {
+		return (a.(tree.Int) + b.(tree.Int)) / 2
+	}
+
+	var rb tree.RedBlackTree
+	if item := rb.KeyMidpoint(mid); item != nil {
+		t.Fatalf("Unexpected midpoint for empty tree: %v", item)
+	}
+
+	// Most items are clustered at the low end of the key range.
+	for i := 0; i < 100; i++ {
+		rb.Upsert(tree.Int(i))
+	}
+	rb.Upsert(tree.Int(500))
+	rb.Upsert(tree.Int(1000))
+
+	if item := rb.KeyMidpoint(mid); item != tree.Int(500) {
+		t.Fatalf("Unexpected key midpoint: %v", item)
+	}
+	if item := rb.Median(); item != tree.Int(51) {
+		t.Fatalf("Unexpected median: %v", item)
+	}
+
+	rb.Delete(tree.Int(500))
+	if item := rb.KeyMidpoint(mid); item != tree.Int(1000) {
+		t.Fatalf("Unexpected key midpoint: %v", item)
+	}
+}
+
+func TestAscendFilter(t *testing.T) {
+	var rb tree.RedBlackTree
+	for i := 0; i < 100; i++ {
+		rb.Upsert(tree.Int(i))
+	}
+	even := func(item tree.Item) bool { return item.(tree.Int)%2 == 0 }
+
+	var visited []int
+	count := rb.AscendFilter(even, func(item tree.Item) bool {
+		visited = append(visited, int(item.(tree.Int)))
+		return true
+	})
+	if count != 50 || len(visited) != 50 {
+		t.Fatalf("Unexpected number of items visited: %d, %d", count, len(visited))
+	}
+	for i, v := range visited {
+		if v != i*2 {
+			t.Fatalf("Unexpected visited item: %d - %d", v, i*2)
+		}
+	}
+
+	count = rb.AscendFilter(even, func(item tree.Item) bool {
+		return item.(tree.Int) < 10
+	})
+	if count != 6 {
+		t.Fatalf("Unexpected number of items visited: %d", count)
+	}
+}
+
+func TestCheckDuplicates(t *testing.T) {
+	if groups := tree.CheckDuplicates(nil); len(groups) != 0 {
+		t.Fatalf("Unexpected groups for empty batch: %v", groups)
+	}
+
+	batch := []tree.Item{
+		&counter{key: 5, count: 0},
+		&counter{key: 1, count: 1},
+		&counter{key: 5, count: 2},
+		&counter{key: 3, count: 3},
+		&counter{key: 1, count: 4},
+		&counter{key: 5, count: 5},
+		&counter{key: 7, count: 6},
+	}
+	groups := tree.CheckDuplicates(batch)
+	expected := [][]int{{1, 4}, {0, 2, 5}}
+	if len(groups) != len(expected) {
+		t.Fatalf("Unexpected number of groups: %d", len(groups))
+	}
+	for i, group := range groups {
+		if len(group) != len(expected[i]) {
+			t.Fatalf("Unexpected group size: %d - %d", len(group), len(expected[i]))
+		}
+		for j, item := range group {
+			if item != batch[expected[i][j]] {
+				t.Fatalf("Unexpected item in group %d: %v", i, item)
+			}
+		}
+	}
+	if batch[0].(*counter).count != 0 || batch[6].(*counter).count != 6 {
+		t.Fatal("Unexpected modification of batch")
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	var rb tree.RedBlackTree
+	rng := rand.New(rand.NewSource(1))
+	for rb.Size() < 10000 {
+		rb.Upsert(tree.Int(rng.Intn(100000)))
+	}
+	rb.Upsert(tree.Int(-1))
+	rb.Upsert(tree.Int(100000))
+
+	counts := rb.Histogram(tree.Int(0), tree.Int(99999), 10, func(item tree.Item) int {
+		return int(item.(tree.Int)) / 10000
+	})
+	if len(counts) != 10 {
+		t.Fatalf("Unexpected number of buckets: %d", len(counts))
+	}
+	var total int
+	for i, count := range counts {
+		if count < 800 || count > 1200 {
+			t.Fatalf("Unexpected count for bucket %d: %d", i, count)
+		}
+		total += count
+	}
+	if total != 10000 {
+		t.Fatalf("Unexpected total count: %d", total)
+	}
+
+	// -1 falls in the first bucket, while 100000 falls in bucket 10 and is
+	// ignored.
+	counts = rb.Histogram(tree.Int(-1), tree.Int(100000), 10, func(item tree.Item) int {
+		return int(item.(tree.Int)) / 10000
+	})
+	if counts[0] != 1+rb.Histogram(tree.Int(0), tree.Int(9999), 1, func(tree.Item) int { return 0 })[0] {
+		t.Fatalf("Unexpected count for first bucket: %d", counts[0])
+	}
+}
+
+func TestFirstNWhere(t *testing.T) {
+	var rb tree.RedBlackTree
+	for i := 0; i < 100000; i++ {
+		rb.Upsert(tree.Int(i))
+	}
+
+	var calls int
+	items := rb.FirstNWhere(5, func(item tree.Item) bool {
+		calls++
+		return item.(tree.Int)%2 == 0
+	})
+	if len(items) != 5 || calls != 9 {
+		t.Fatalf("Unexpected result: %v, %d", items, calls)
+	}
+	for i, item := range items {
+		if item != tree.Int(i*2) {
+			t.Fatalf("Unexpected item: %v - %d", item, i*2)
+		}
+	}
+
+	items = rb.FirstNWhere(5, func(item tree.Item) bool {
+		return item.(tree.Int) >= 99997
+	})
+	if len(items) != 3 || items[0] != tree.Int(99997) {
+		t.Fatalf("Unexpected result: %v", items)
+	}
+}
+
+func TestVersionedAscend(t *testing.T) {
+	var rb tree.RedBlackTree
+	for i := 0; i < 100; i++ {
+		rb.Upsert(tree.Int(i))
+	}
+
+	var count int
+	if err := rb.VersionedAscend(func(tree.Item) bool {
+		count++
+		return true
+	}); err != nil || count != 100 {
+		t.Fatalf("Unexpected result without writes: %v, %d", err, count)
+	}
+
+	count = 0
+	err := rb.VersionedAscend(func(tree.Item) bool {
+		count++
+		if count == 10 {
+			rb.Upsert(tree.Int(1000))
+		}
+		return true
+	})
+	if err != tree.ErrVersionConflict || count != 10 {
+		t.Fatalf("Unexpected result with a write: %v, %d", err, count)
+	}
+
+	// Retrying without a write succeeds.
+	count = 0
+	if err := rb.VersionedAscend(func(tree.Item) bool {
+		count++
+		return true
+	}); err != nil || count != 101 {
+		t.Fatalf("Unexpected result on retry: %v, %d", err, count)
+	}
+
+	// Writes that leave the tree unchanged do not conflict.
+	ro := tree.NewInsertOnce()
+	ro.Upsert(tree.Int(1))
+	if err := ro.VersionedAscend(func(tree.Item) bool {
+		ro.Upsert(tree.Int(1))
+		ro.Delete(tree.Int(2))
+		return true
+	}); err != nil {
+		t.Fatalf("Unexpected conflict for no-op writes: %v", err)
+	}
+}
+
+func TestJaccard(t *testing.T) {
+	var a, b tree.RedBlackTree
+	if j := a.Jaccard(&b); j != 1 {
+		t.Fatalf("Unexpected similarity of empty trees: %v", j)
+	}
+
+	rng := rand.New(rand.NewSource(1))
+	as, bs := make(map[int]bool), make(map[int]bool)
+	for i := 0; i < 500; i++ {
+		k := rng.Intn(1000)
+		a.Upsert(tree.Int(k))
+		as[k] = true
+		k = rng.Intn(1000)
+		b.Upsert(tree.Int(k))
+		bs[k] = true
+	}
+	var intersection int
+	for k := range as {
+		if bs[k] {
+			intersection++
+		}
+	}
+	expected := float64(intersection) / float64(len(as)+len(bs)-intersection)
+	if j := a.Jaccard(&b); j != expected {
+		t.Fatalf("Unexpected similarity: %v - %v", j, expected)
+	}
+	if j := a.Jaccard(&a); j != 1 {
+		t.Fatalf("Unexpected similarity with self: %v", j)
+	}
+
+	var c tree.RedBlackTree
+	for i := 1000; i < 1100; i++ {
+		c.Upsert(tree.Int(i))
+	}
+	if j := a.Jaccard(&c); j != 0 {
+		t.Fatalf("Unexpected similarity of disjoint trees: %v", j)
+	}
+}
+
+func TestAscendRunLengths(t *testing.T) {
+	sameRun := func(a, b tree.Item) bool {
+		return b.(tree.Int)-a.(tree.Int) == 1
+	}
+
+	var rb tree.RedBlackTree
+	if lengths := rb.AscendRunLengths(sameRun); len(lengths) != 0 {
+		t.Fatalf("Unexpected run lengths for empty tree: %v", lengths)
+	}
+
+	for i := 10; i < 30; i++ {
+		rb.Upsert(tree.Int(i))
+	}
+	rb.Upsert(tree.Int(35))
+	for i := 50; i < 55; i++ {
+		rb.Upsert(tree.Int(i))
+	}
+	rb.Upsert(tree.Int(60))
+
+	lengths := rb.AscendRunLengths(sameRun)
+	expected := []int{20, 1, 5, 1}
+	if len(lengths) != len(expected) {
+		t.Fatalf("Unexpected run lengths: %v", lengths)
+	}
+	for i := range expected {
+		if lengths[i] != expected[i] {
+			t.Fatalf("Unexpected run lengths: %v", lengths)
+		}
+	}
+}
+
+func TestIsSortedBy(t *testing.T) {
+	var rb tree.RedBlackTree
+	if !rb.IsSortedBy(func(a, b tree.Item) bool { return false }) {
+		t.Fatal("Unexpected unsorted empty tree")
+	}
+
+	for i := 0; i < 100; i++ {
+		rb.Upsert(&counter{key: i, count: i / 10})
+	}
+	if !rb.IsSortedBy(func(a, b tree.Item) bool { return a.Less(b) }) {
+		t.Fatal("Unexpected unsorted tree for current ordering")
+	}
+	if rb.IsSortedBy(func(a, b tree.Item) bool { return b.Less(a) }) {
+		t.Fatal("Unexpected sorted tree for inverted ordering")
+	}
+	// Ordering by count would make items with equal counts collide.
+	if rb.IsSortedBy(func(a, b tree.Item) bool { return a.(*counter).count < b.(*counter).count }) {
+		t.Fatal("Unexpected sorted tree for ordering with equal items")
+	}
+}
+
+func TestDownsample(t *testing.T) {
+	var rb tree.RedBlackTree
+	for _, i := range rand.Perm(1000) {
+		rb.Upsert(tree.Int(i * 2))
+	}
+
+	ds := rb.Downsample(10)
+	if err := tree.Verify(ds); err != nil {
+		t.Fatalf("Invalid tree: %v", err)
+	}
+	if ds.Size() != 100 {
+		t.Fatalf("Unexpected size: %d", ds.Size())
+	}
+	rank := 0
+	ds.Ascend(func(item tree.Item) bool {
+		if item != tree.Int(rank*2) {
+			t.Fatalf("Unexpected item: %v - rank %d", item, rank)
+		}
+		rank += 10
+		return true
+	})
+	if rb.Size() != 1000 {
+		t.Fatalf("Unexpected modification of source tree: %d", rb.Size())
+	}
+
+	if ds := rb.Downsample(999); ds.Size() != 2 || ds.Max() != tree.Int(1998) {
+		t.Fatalf("Unexpected downsampled tree: %d, %v", ds.Size(), ds.Max())
+	}
+}
+
+func TestTakeWhileBudget(t *testing.T) {
+	size := func(item tree.Item) float64 { return float64(item.(*counter).count) }
+
+	var rb tree.RedBlackTree
+	for i, count := range []int{3, 5, 2, 8, 1, 1} {
+		rb.Upsert(&counter{key: i, count: count})
+	}
+
+	tests := []struct {
+		budget float64
+		keys   int
+	}{
+		{budget: 0, keys: 0},
+		{budget: 2, keys: 0},
+		{budget: 3, keys: 1},
+		{budget: 10, keys: 3},
+		{budget: 17, keys: 3},
+		{budget: 18, keys: 4},
+		{budget: 100, keys: 6},
+	}
+	for _, test := range tests {
+		items := rb.TakeWhileBudget(size, test.budget)
+		if len(items) != test.keys {
+			t.Fatalf("Unexpected number of items for budget %v: %d", test.budget, len(items))
+		}
+		for i, item := range items {
+			if item.(*counter).key != i {
+				t.Fatalf("Unexpected item for budget %v: %v", test.budget, item)
+			}
+		}
+	}
+}
+
+func TestSplitN(t *testing.T) {
+	var rb tree.RedBlackTree
+	for _, i := range rand.Perm(1000) {
+		rb.Upsert(tree.Int(i))
+	}
+
+	parts := rb.SplitN(4)
+	if len(parts) != 4 {
+		t.Fatalf("Unexpected number of parts: %d", len(parts))
+	}
+	next := 0
+	for i, part := range parts {
+		if err := tree.Verify(part); err != nil {
+			t.Fatalf("Invalid tree for part %d: %v", i, err)
+		}
+		if part.Size() != 250 {
+			t.Fatalf("Unexpected size for part %d: %d", i, part.Size())
+		}
+		part.Ascend(func(item tree.Item) bool {
+			if item != tree.Int(next) {
+				t.Fatalf("Unexpected item in part %d: %v - expected %d", i, item, next)
+			}
+			next++
+			return true
+		})
+	}
+	if next != 1000 {
+		t.Fatalf("Unexpected number of items across parts: %d", next)
+	}
+	if rb.Size() != 1000 {
+		t.Fatalf("Unexpected modification of source tree: %d", rb.Size())
+	}
+
+	parts = rb.SplitN(3)
+	for i, size := range []int{334, 333, 333} {
+		if parts[i].Size() != size {
+			t.Fatalf("Unexpected size for part %d: %d", i, parts[i].Size())
+		}
+	}
+	if !parts[0].Max().Less(parts[1].Min()) || !parts[1].Max().Less(parts[2].Min()) {
+		t.Fatalf("Unexpected overlapping parts")
+	}
+
+	var empty tree.RedBlackTree
+	for _, part := range empty.SplitN(2) {
+		if part.Size() != 0 {
+			t.Fatalf("Unexpected size for empty part: %d", part.Size())
+		}
+	}
+}
+
+func TestLazyDeleteStructure(t *testing.T) {
+	rb := tree.NewLazyDelete()
+	for i := 0; i < 10; i++ {
+		rb.Upsert(tree.String(string(rune('a' + i))))
+	}
+	for i := 0; i < 10; i++ {
+		rb.Delete(tree.String(string(rune('a' + i))))
+	}
+	if prefix := rb.CommonPrefix(); prefix != "" {
+		t.Fatalf("Unexpected prefix for fully tombstoned tree: %q", prefix)
+	}
+
+	rb = tree.NewLazyDelete()
+	for i := 0; i < 100; i++ {
+		rb.Upsert(tree.Int(i))
+	}
+	for i := 0; i < 100; i += 3 {
+		rb.Delete(tree.Int(i))
+	}
+
+	built := tree.BuildFromArray(rb.FlattenToArray())
+	if err := tree.Verify(built); err != nil {
+		t.Fatalf("Invalid tree: %v", err)
+	}
+	if built.Size() != rb.Size() {
+		t.Fatalf("Unexpected size after round trip: %d - %d", built.Size(), rb.Size())
+	}
+	if built.Exists(tree.Int(3)) || !built.Exists(tree.Int(4)) {
+		t.Fatal("Unexpected existence of items after round trip")
+	}
+	if removed := built.Compact(); removed != 34 {
+		t.Fatalf("Unexpected number of compacted tombstones: %d", removed)
+	}
+
+	var sum int
+	for size, count := range rb.SubtreeSizeHistogram() {
+		sum += count
+		if size > rb.Size() {
+			t.Fatalf("Unexpected subtree size: %d", size)
+		}
+	}
+	if sum != rb.Size() {
+		t.Fatalf("Unexpected histogram sum: %d - %d", sum, rb.Size())
+	}
+
+	sum = 0
+	for _, width := range rb.LevelWidths() {
+		sum += width
+	}
+	if sum != rb.Size() {
+		t.Fatalf("Unexpected level width sum: %d - %d", sum, rb.Size())
+	}
+
+	rb.AscendLeaves(func(item tree.Item, _ int) bool {
+		if !rb.Exists(item) {
+			t.Fatalf("Unexpected tombstoned leaf: %v", item)
+		}
+		return true
+	})
+}
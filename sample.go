@@ -0,0 +1,109 @@
+// MIT License
+//
+// Copyright (c) 2017 Ryan Fowler
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package tree
+
+import "math/rand"
+
+// SampledTree retains a uniform random sample of at most a fixed number of the
+// items upserted into it, using reservoir sampling. Once full, each new item
+// is retained with a probability equal to the sample size divided by the
+// number of items seen, replacing a randomly chosen retained item.
+//
+// This bounds the memory used by an index over an unbounded stream of items,
+// such as for computing approximate quantiles. Items in the stream are
+// expected to be distinct; upserting an item equal to a retained item replaces
+// it without affecting the sample.
+type SampledTree struct {
+	t     RedBlackTree
+	rng   *rand.Rand
+	slots []Item
+	max   int
+	seen  int
+}
+
+// NewSampledTree returns a new, empty SampledTree that retains at most
+// 'maxSize' items, choosing the items to retain using 'rng'.
+func NewSampledTree(maxSize int, rng *rand.Rand) *SampledTree {
+	return &SampledTree{
+		rng:   rng,
+		slots: make([]Item, 0, maxSize),
+		max:   maxSize,
+	}
+}
+
+// Upsert offers an item from the stream to the sample, returning 'true' if it
+// was retained.
+//
+// O(log(n))
+func (s *SampledTree) Upsert(item Item) bool {
+	s.seen++
+	if s.t.Exists(item) {
+		s.t.Upsert(item)
+		return true
+	}
+	if len(s.slots) < s.max {
+		s.t.Upsert(item)
+		s.slots = append(s.slots, item)
+		return true
+	}
+	j := s.rng.Intn(s.seen)
+	if j >= s.max {
+		return false
+	}
+	s.t.Delete(s.slots[j])
+	s.t.Upsert(item)
+	s.slots[j] = item
+	return true
+}
+
+// Seen returns the number of items offered to the sample.
+//
+// O(1)
+func (s *SampledTree) Seen() int {
+	return s.seen
+}
+
+// Size returns the number of items retained in the sample.
+//
+// O(1)
+func (s *SampledTree) Size() int {
+	return s.t.Size()
+}
+
+// Ascend calls 'fn' for each retained item in ascending order until no items
+// remain or fn returns 'false'.
+//
+// O(log(n) + m) where n is the number of retained items and m is the number of
+// items ranged over.
+func (s *SampledTree) Ascend(fn func(Item) bool) {
+	s.t.Ascend(fn)
+}
+
+// ItemAtFraction returns the retained item at rank floor(f * (Size() - 1)),
+// which approximates the f-quantile of the stream. If no items are retained,
+// nil is returned.
+//
+// O(log(n) + n/2) where n is the number of retained items.
+func (s *SampledTree) ItemAtFraction(f float64) Item {
+	return s.t.ItemAtFraction(f)
+}
@@ -0,0 +1,38 @@
+package tree_test
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/ryanfowler/tree"
+)
+
+func TestSampledTree(t *testing.T) {
+	const stream = 100000
+	const size = 1000
+	const buckets = 10
+
+	s := tree.NewSampledTree(size, rand.New(rand.NewSource(1)))
+	for i := 0; i < stream; i++ {
+		s.Upsert(tree.Int(i))
+	}
+	if s.Size() != size || s.Seen() != stream {
+		t.Fatalf("Unexpected sample size: %d, %d", s.Size(), s.Seen())
+	}
+
+	// Each bucket of the stream should hold about a tenth of the sample.
+	counts := make([]int, buckets)
+	s.Ascend(func(item tree.Item) bool {
+		counts[int(item.(tree.Int))*buckets/stream]++
+		return true
+	})
+	for i, count := range counts {
+		if count < size/buckets*7/10 || count > size/buckets*13/10 {
+			t.Fatalf("Unexpected count for bucket %d: %d", i, count)
+		}
+	}
+
+	if median := int(s.ItemAtFraction(0.5).(tree.Int)); median < stream*4/10 || median > stream*6/10 {
+		t.Fatalf("Unexpected median of sample: %d", median)
+	}
+}
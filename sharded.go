@@ -0,0 +1,211 @@
+// MIT License
+//
+// Copyright (c) 2017 Ryan Fowler
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package tree
+
+import (
+	"container/heap"
+	"sync"
+)
+
+// ShardedTree partitions items across a number of independent RedBlackTrees,
+// each protected by its own lock, allowing writes to different shards to
+// proceed concurrently.
+//
+// Items are assigned to shards by a caller-supplied shard function. Equal
+// items must always be assigned to the same shard. Operations on a single item
+// only lock its shard, while ordered iteration merges the items of all shards
+// to produce globally sorted output.
+//
+// Unlike a RedBlackTree, all methods of a ShardedTree are safe for concurrent
+// use.
+type ShardedTree struct {
+	shard  func(Item) int
+	shards []treeShard
+}
+
+type treeShard struct {
+	mu sync.RWMutex
+	t  RedBlackTree
+}
+
+// NewShardedTree returns a new, empty ShardedTree with 'n' shards. The
+// function 'shard' must return the index of an item's shard, in the range
+// [0, n).
+func NewShardedTree(n int, shard func(Item) int) *ShardedTree {
+	return &ShardedTree{
+		shard:  shard,
+		shards: make([]treeShard, n),
+	}
+}
+
+// Ascend starts at the first Item across all shards and calls 'fn' for each
+// Item until no Items remain or fn returns 'false'. All shards are read locked
+// for the duration of the iteration, so fn must not call any methods of the
+// ShardedTree. Even a read may deadlock, as read locks can't be acquired
+// recursively while a writer is waiting.
+//
+// O(s*log(n) + m*log(s)) where s is the number of shards, n is the total
+// number of items in the tree, and m is the number of items ranged over.
+func (st *ShardedTree) Ascend(fn func(Item) bool) {
+	st.merge(false, fn)
+}
+
+// Descend starts at the last Item across all shards and calls 'fn' for each
+// Item until no Items remain or fn returns 'false'. All shards are read locked
+// for the duration of the iteration, so fn must not call any methods of the
+// ShardedTree. Even a read may deadlock, as read locks can't be acquired
+// recursively while a writer is waiting.
+//
+// O(s*log(n) + m*log(s)) where s is the number of shards, n is the total
+// number of items in the tree, and m is the number of items ranged over.
+func (st *ShardedTree) Descend(fn func(Item) bool) {
+	st.merge(true, fn)
+}
+
+func (st *ShardedTree) merge(desc bool, fn func(Item) bool) {
+	h := &cursorHeap{desc: desc}
+	for i := range st.shards {
+		s := &st.shards[i]
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		n := s.t.minNode()
+		if desc {
+			n = s.t.maxNode()
+		}
+		if n != nil {
+			h.nodes = append(h.nodes, n)
+		}
+	}
+	heap.Init(h)
+
+	for h.Len() > 0 {
+		n := h.nodes[0]
+		if !fn(n.item) {
+			return
+		}
+		if desc {
+			n = n.prev()
+		} else {
+			n = n.next()
+		}
+		if n != nil {
+			h.nodes[0] = n
+			heap.Fix(h, 0)
+		} else {
+			heap.Pop(h)
+		}
+	}
+}
+
+// Delete deletes an item in the ShardedTree equal to the provided item. If an
+// item was deleted, it is returned. Otherwise, nil is returned.
+//
+// O(log(n))
+func (st *ShardedTree) Delete(item Item) Item {
+	s := st.shardFor(item)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.t.Delete(item)
+}
+
+// Exists returns 'true' if an item equal to the provided item exists in the
+// ShardedTree.
+//
+// O(log(n))
+func (st *ShardedTree) Exists(item Item) bool {
+	return st.Get(item) != nil
+}
+
+// Get retrieves an item in the ShardedTree equal to the provided item. If an
+// item was found, it is returned. Otherwise, nil is returned.
+//
+// O(log(n))
+func (st *ShardedTree) Get(item Item) Item {
+	s := st.shardFor(item)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.t.Get(item)
+}
+
+// Max returns the maximum item across all shards. If the tree is empty, nil is
+// returned.
+//
+// O(s*log(n)) where s is the number of shards.
+func (st *ShardedTree) Max() Item {
+	var max Item
+	for i := range st.shards {
+		s := &st.shards[i]
+		s.mu.RLock()
+		if item := s.t.Max(); item != nil && (max == nil || max.Less(item)) {
+			max = item
+		}
+		s.mu.RUnlock()
+	}
+	return max
+}
+
+// Min returns the minimum item across all shards. If the tree is empty, nil is
+// returned.
+//
+// O(s*log(n)) where s is the number of shards.
+func (st *ShardedTree) Min() Item {
+	var min Item
+	for i := range st.shards {
+		s := &st.shards[i]
+		s.mu.RLock()
+		if item := s.t.Min(); item != nil && (min == nil || item.Less(min)) {
+			min = item
+		}
+		s.mu.RUnlock()
+	}
+	return min
+}
+
+// Size returns the total number of items across all shards.
+//
+// O(s) where s is the number of shards.
+func (st *ShardedTree) Size() int {
+	var size int
+	for i := range st.shards {
+		s := &st.shards[i]
+		s.mu.RLock()
+		size += s.t.Size()
+		s.mu.RUnlock()
+	}
+	return size
+}
+
+// Upsert inserts (or replaces) an item into its shard of the ShardedTree. If
+// an item was replaced, it is returned. Otherwise, nil is returned.
+//
+// O(log(n))
+func (st *ShardedTree) Upsert(item Item) Item {
+	s := st.shardFor(item)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.t.Upsert(item)
+}
+
+func (st *ShardedTree) shardFor(item Item) *treeShard {
+	return &st.shards[st.shard(item)]
+}
@@ -0,0 +1,85 @@
+package tree_test
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/ryanfowler/tree"
+)
+
+func TestShardedTree(t *testing.T) {
+	const shards = 4
+	const perWriter = 500
+
+	st := tree.NewShardedTree(shards, func(item tree.Item) int {
+		return int(item.(tree.Int)) % shards
+	})
+	if st.Min() != nil || st.Max() != nil || st.Size() != 0 {
+		t.Fatalf("Unexpected non-empty tree: %v, %v, %d", st.Min(), st.Max(), st.Size())
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < shards; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWriter; i++ {
+				st.Upsert(tree.Int(i*shards + w))
+			}
+		}(w)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 10; i++ {
+			var prev tree.Item
+			st.Ascend(func(item tree.Item) bool {
+				if prev != nil && !prev.Less(item) {
+					t.Errorf("Unexpected order during writes: %v, %v", prev, item)
+				}
+				prev = item
+				return true
+			})
+		}
+	}()
+	wg.Wait()
+
+	const size = shards * perWriter
+	if st.Size() != size {
+		t.Fatalf("Unexpected size: %d", st.Size())
+	}
+	if st.Min() != tree.Int(0) || st.Max() != tree.Int(size-1) {
+		t.Fatalf("Unexpected min/max: %v, %v", st.Min(), st.Max())
+	}
+
+	var i int
+	st.Ascend(func(item tree.Item) bool {
+		if int(item.(tree.Int)) != i {
+			t.Fatalf("Unexpected ascend value: %v - %d", item, i)
+		}
+		i++
+		return true
+	})
+	if i != size {
+		t.Fatalf("Unexpected number of items: %d", i)
+	}
+
+	i = size - 1
+	st.Descend(func(item tree.Item) bool {
+		if int(item.(tree.Int)) != i {
+			t.Fatalf("Unexpected descend value: %v - %d", item, i)
+		}
+		i--
+		return i > size-10
+	})
+
+	if !st.Exists(tree.Int(42)) || st.Get(tree.Int(42)) != tree.Int(42) {
+		t.Fatal("Expected item to exist")
+	}
+	if it := st.Delete(tree.Int(42)); it != tree.Int(42) {
+		t.Fatalf("Unexpected deleted item: %v", it)
+	}
+	if st.Exists(tree.Int(42)) || st.Size() != size-1 {
+		t.Fatalf("Unexpected tree after delete: %d", st.Size())
+	}
+}
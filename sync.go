@@ -0,0 +1,167 @@
+// MIT License
+//
+// Copyright (c) 2017 Ryan Fowler
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package tree
+
+import "sync"
+
+// SyncTree wraps a RedBlackTree with a read-write lock, making all of its
+// methods safe for concurrent use. Read operations hold the read lock, allowing
+// them to proceed concurrently, while write operations hold the write lock.
+//
+// Compound operations spanning several calls, such as a read-modify-write,
+// can be performed atomically with Do.
+type SyncTree struct {
+	mu sync.RWMutex
+	t  *RedBlackTree
+}
+
+// NewSyncTree returns a new SyncTree wrapping the provided RedBlackTree, which
+// must not be accessed directly afterwards. If 't' is nil, a new, empty tree is
+// used.
+func NewSyncTree(t *RedBlackTree) *SyncTree {
+	if t == nil {
+		t = &RedBlackTree{}
+	}
+	return &SyncTree{t: t}
+}
+
+// Do calls 'fn' with the underlying RedBlackTree while holding the write lock,
+// giving fn exclusive access to the tree for the duration of the call. The
+// tree must not be retained or accessed by fn after it returns, including by
+// any goroutines it starts, and fn must not call any methods of the SyncTree.
+func (st *SyncTree) Do(fn func(t *RedBlackTree)) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	fn(st.t)
+}
+
+// Ascend starts at the first Item and calls 'fn' for each Item until no Items
+// remain or fn returns 'false'. The read lock is held for the duration of the
+// iteration, so fn must not call any methods of the SyncTree: a write would
+// deadlock, as would a read if a writer is waiting for the lock.
+//
+// O(log(n) + m) where n is the total number of items in the tree and m is the
+// number of items ranged over.
+func (st *SyncTree) Ascend(fn func(Item) bool) {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	st.t.Ascend(fn)
+}
+
+// Delete deletes an item in the SyncTree equal to the provided item. If an item
+// was deleted, it is returned. Otherwise, nil is returned.
+//
+// O(log(n))
+func (st *SyncTree) Delete(item Item) Item {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.t.Delete(item)
+}
+
+// Exists returns 'true' if an item equal to the provided item exists in the
+// SyncTree.
+//
+// O(log(n))
+func (st *SyncTree) Exists(item Item) bool {
+	return st.Get(item) != nil
+}
+
+// Get retrieves an item in the SyncTree equal to the provided item. If an item
+// was found, it is returned. Otherwise, nil is returned.
+//
+// O(log(n))
+func (st *SyncTree) Get(item Item) Item {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	return st.t.Get(item)
+}
+
+// Max returns the maximum item in the SyncTree. If the tree is empty, nil is
+// returned.
+//
+// O(log(n))
+func (st *SyncTree) Max() Item {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	return st.t.Max()
+}
+
+// Min returns the minimum item in the SyncTree. If the tree is empty, nil is
+// returned.
+//
+// O(log(n))
+func (st *SyncTree) Min() Item {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	return st.t.Min()
+}
+
+// Size returns the number of items in the SyncTree.
+//
+// O(1)
+func (st *SyncTree) Size() int {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	return st.t.Size()
+}
+
+// Upsert inserts (or replaces) an item into the SyncTree. If an item was
+// replaced, it is returned. Otherwise, nil is returned.
+//
+// O(log(n))
+func (st *SyncTree) Upsert(item Item) Item {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.t.Upsert(item)
+}
+
+// VersionedAscend starts at the first Item and calls 'fn' for each Item until
+// no Items remain or fn returns 'false'. Unlike Ascend, the read lock is only
+// held while moving between Items and not while fn runs, so writers may
+// proceed during the iteration. If the tree is modified while fn runs, the
+// iteration is aborted after fn returns and ErrVersionConflict is returned,
+// allowing the caller to retry. Every Item passed to fn is therefore from the
+// same version of the tree.
+//
+// O(log(n) + m) where n is the total number of items in the tree and m is the
+// number of items ranged over.
+func (st *SyncTree) VersionedAscend(fn func(Item) bool) error {
+	st.mu.RLock()
+	version := st.t.version
+	for n := st.t.minNode(); n != nil; n = n.next() {
+		item := n.item
+		st.mu.RUnlock()
+		if !fn(item) {
+			return nil
+		}
+		st.mu.RLock()
+		// Writes may have released or reused the node, so it must not be
+		// followed if the version has changed.
+		if st.t.version != version {
+			st.mu.RUnlock()
+			return ErrVersionConflict
+		}
+	}
+	st.mu.RUnlock()
+	return nil
+}
@@ -0,0 +1,116 @@
+package tree_test
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/ryanfowler/tree"
+)
+
+func TestSyncTreeDo(t *testing.T) {
+	const workers = 4
+	const increments = 500
+
+	st := tree.NewSyncTree(nil)
+	st.Upsert(&counter{key: 0})
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(2)
+		// Increment the counter with a read-modify-write under the lock.
+		go func() {
+			defer wg.Done()
+			for i := 0; i < increments; i++ {
+				st.Do(func(rb *tree.RedBlackTree) {
+					c := rb.Get(&counter{key: 0}).(*counter)
+					rb.Upsert(&counter{key: 0, count: c.count + 1})
+				})
+			}
+		}()
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < increments; i++ {
+				key := w*increments + i + 1
+				st.Upsert(&counter{key: key})
+				if !st.Exists(&counter{key: key}) {
+					t.Errorf("Missing item: %d", key)
+				}
+				st.Ascend(func(tree.Item) bool { return false })
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	if c := st.Get(&counter{key: 0}).(*counter); c.count != workers*increments {
+		t.Fatalf("Unexpected count: %d", c.count)
+	}
+	if st.Size() != workers*increments+1 {
+		t.Fatalf("Unexpected size: %d", st.Size())
+	}
+	st.Do(func(rb *tree.RedBlackTree) {
+		if err := tree.Verify(rb); err != nil {
+			t.Fatalf("Invalid tree: %v", err)
+		}
+	})
+}
+
+func TestSyncTreeVersionedAscend(t *testing.T) {
+	st := tree.NewSyncTree(nil)
+	for i := 0; i < 100; i++ {
+		st.Upsert(tree.Int(i))
+	}
+
+	// A write from another goroutine while fn runs causes a conflict.
+	var count int
+	err := st.VersionedAscend(func(tree.Item) bool {
+		count++
+		if count == 10 {
+			var wg sync.WaitGroup
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				st.Upsert(tree.Int(1000))
+			}()
+			wg.Wait()
+		}
+		return true
+	})
+	if err != tree.ErrVersionConflict || count != 10 {
+		t.Fatalf("Unexpected result with a write: %v, %d", err, count)
+	}
+
+	// Readers retry on conflict while a writer runs concurrently.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 2000; i++ {
+			st.Upsert(tree.Int(i % 200))
+			st.Delete(tree.Int((i + 100) % 200))
+		}
+	}()
+	for finished := false; !finished; {
+		select {
+		case <-done:
+			finished = true
+		default:
+		}
+		var last tree.Item
+		if err := st.VersionedAscend(func(item tree.Item) bool {
+			if last != nil && !last.Less(item) {
+				t.Fatalf("Unexpected order: %v, %v", last, item)
+			}
+			last = item
+			return true
+		}); err != nil && err != tree.ErrVersionConflict {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	count = 0
+	if err := st.VersionedAscend(func(tree.Item) bool {
+		count++
+		return true
+	}); err != nil || count != st.Size() {
+		t.Fatalf("Unexpected result without writers: %v, %d", err, count)
+	}
+}
@@ -0,0 +1,48 @@
+// MIT License
+//
+// Copyright (c) 2017 Ryan Fowler
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package treetest provides utilities for testing code that uses the tree
+// package.
+package treetest
+
+import (
+	"testing"
+
+	"github.com/ryanfowler/tree"
+)
+
+// AssertComparator checks that the Less method of every pair of the provided
+// items agrees with the sign of the reference comparison function 'ref', which
+// must return a negative number if a is less than b, and reports each
+// disagreement as an error on 't'.
+//
+// O(n^2) where n is the number of items.
+func AssertComparator(t testing.TB, items []tree.Item, ref func(a, b tree.Item) int) {
+	t.Helper()
+	for _, a := range items {
+		for _, b := range items {
+			if less, cmp := a.Less(b), ref(a, b); less != (cmp < 0) {
+				t.Errorf("treetest: %v.Less(%v) is %t, but the reference comparison is %d", a, b, less, cmp)
+			}
+		}
+	}
+}
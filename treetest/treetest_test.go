@@ -0,0 +1,60 @@
+package treetest_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/ryanfowler/tree"
+	"github.com/ryanfowler/tree/treetest"
+)
+
+// recorder records the errors reported to it rather than failing the test.
+type recorder struct {
+	testing.TB
+	errors []string
+}
+
+func (r *recorder) Helper() {}
+
+func (r *recorder) Errorf(format string, args ...interface{}) {
+	r.errors = append(r.errors, fmt.Sprintf(format, args...))
+}
+
+// reversed is an Item with a Less method that is inconsistent with the
+// ordering of integers for negative values.
+type reversed int
+
+func (r reversed) Less(than tree.Item) bool {
+	o := than.(reversed)
+	if r < 0 && o < 0 {
+		return r > o
+	}
+	return r < o
+}
+
+func TestAssertComparator(t *testing.T) {
+	var items []tree.Item
+	for i := -5; i <= 5; i++ {
+		items = append(items, tree.Int(i))
+	}
+	rec := &recorder{TB: t}
+	treetest.AssertComparator(rec, items, func(a, b tree.Item) int {
+		return int(a.(tree.Int) - b.(tree.Int))
+	})
+	if len(rec.errors) != 0 {
+		t.Fatalf("Unexpected errors for consistent comparator: %v", rec.errors)
+	}
+
+	items = items[:0]
+	for i := -5; i <= 5; i++ {
+		items = append(items, reversed(i))
+	}
+	rec = &recorder{TB: t}
+	treetest.AssertComparator(rec, items, func(a, b tree.Item) int {
+		return int(a.(reversed) - b.(reversed))
+	})
+	// Every ordered pair of distinct negative values disagrees.
+	if len(rec.errors) != 5*4 {
+		t.Fatalf("Unexpected number of errors for inconsistent comparator: %d", len(rec.errors))
+	}
+}